@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// thresholds are the shares of used IPs, in percent, from which on a
+// network is alerted about. 0 disables a level.
+type thresholds struct {
+	Warning  int `yaml:"warning" json:"warning"`
+	Critical int `yaml:"critical" json:"critical"`
+}
+
+func (t thresholds) validate() error {
+	if t.Warning < 0 || t.Warning > 100 || t.Critical < 0 || t.Critical > 100 {
+		return errors.New("thresholds have to be between 0 and 100 percent")
+	}
+	if t.Warning != 0 && t.Critical != 0 && t.Critical < t.Warning {
+		return errors.New("critical threshold is below the warning threshold")
+	}
+	return nil
+}
+
+// Alert levels, in ascending order of severity.
+const (
+	levelOK       = "ok"
+	levelWarning  = "warning"
+	levelCritical = "critical"
+)
+
+var levelRank = map[string]int{levelOK: 0, levelWarning: 1, levelCritical: 2}
+
+// level returns the alert level of a network with used percent of its IPs
+// in use.
+func (t thresholds) level(used int) string {
+	switch {
+	case t.Critical > 0 && used >= t.Critical:
+		return levelCritical
+	case t.Warning > 0 && used >= t.Warning:
+		return levelWarning
+	}
+	return levelOK
+}
+
+// threshold returns the threshold of level.
+func (t thresholds) threshold(level string) int {
+	switch level {
+	case levelCritical:
+		return t.Critical
+	case levelWarning:
+		return t.Warning
+	}
+	return 0
+}
+
+// alert notifies that the alert level of a network changed.
+type alert struct {
+	Network     string      `json:"network"`
+	CIDR        string      `json:"cidr"`
+	DC          string      `json:"dc"`
+	Level       string      `json:"level"`
+	Previous    string      `json:"previous"`
+	Threshold   int         `json:"threshold"`
+	Utilization utilization `json:"utilization"`
+	Time        time.Time   `json:"time"`
+	Test        bool        `json:"test,omitempty"`
+}
+
+func (a alert) Message() string {
+	prefix := ""
+	if a.Test {
+		prefix = "[TEST] "
+	}
+	where := fmt.Sprintf("network %s (%s", a.Network, a.CIDR)
+	if a.DC != "" {
+		where += ", " + a.DC
+	}
+	where += ")"
+	if a.Level == levelOK {
+		return fmt.Sprintf("%s[OK] %s is %d%% used, back below the %s threshold of %d%%", prefix, where, a.Utilization.UsedPercent, a.Previous, a.Threshold)
+	}
+	return fmt.Sprintf("%s[%s] %s is %d%% used, reaching the %s threshold of %d%% (%d of %d IPs free)", prefix, strings.ToUpper(a.Level), where, a.Utilization.UsedPercent, a.Level, a.Threshold, a.Utilization.Free, a.Utilization.Total)
+}
+
+// Webhook formats.
+const (
+	formatJSON  = "json"
+	formatSlack = "slack"
+	formatTeams = "teams"
+)
+
+// webhook is an URL alerts are posted to, in one of the webhook formats.
+type webhook struct {
+	Format string
+	URL    string
+}
+
+// parseWebhooks reads webhooks separated by commas or whitespace, each in
+// the form "<format>=<url>" or just "<url>" for the generic JSON format.
+func parseWebhooks(spec string) ([]webhook, error) {
+	var out []webhook
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		h := webhook{Format: formatJSON, URL: entry}
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			switch parts[0] {
+			case formatJSON, formatSlack, formatTeams:
+				h = webhook{Format: parts[0], URL: parts[1]}
+			}
+		}
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid webhook %q, expected [json=|slack=|teams=]<http(s) url>", entry)
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// payload returns the body posted for a.
+func (h webhook) payload(a alert) interface{} {
+	switch h.Format {
+	case formatSlack:
+		return map[string]string{"text": a.Message()}
+	case formatTeams:
+		color := map[string]string{levelOK: "2EB886", levelWarning: "FFA500", levelCritical: "D00000"}[a.Level]
+		return map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "http://schema.org/extensions",
+			"themeColor": color,
+			"summary":    a.Message(),
+			"title":      fmt.Sprintf("netmgmt: network %s is %s", a.Network, a.Level),
+			"text":       a.Message(),
+		}
+	}
+	return a
+}
+
+// webhookTimeout is the time a webhook has to accept an alert.
+const webhookTimeout = 10 * time.Second
+
+// send posts a to the webhook.
+func (h webhook) send(a alert) error {
+	b, err := json.Marshal(h.payload(a))
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// redactURL returns raw without its path and query, which often hold a
+// secret.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (h webhook) String() string {
+	return h.Format + " " + redactURL(h.URL)
+}
+
+// alertState is the alert level of a network and since when it is at it.
+type alertState struct {
+	Network     string    `json:"network"`
+	Level       string    `json:"level"`
+	UsedPercent int       `json:"used_percent"`
+	Since       time.Time `json:"since"`
+}
+
+// Alerts evaluates the thresholds of networks after their scans and posts
+// alerts to the webhooks whenever the level of a network changes. To not
+// alert over and over again when the utilization of a network goes up and
+// down around a threshold, the level only goes down once the utilization
+// is Hysteresis percentage points below it.
+type Alerts struct {
+	sync.Mutex
+	Webhooks   []webhook
+	Hysteresis int
+	states     map[string]*alertState
+}
+
+var alerts = Alerts{Hysteresis: 5}
+
+// Evaluate checks the utilization of a network against its thresholds.
+func (a *Alerts) Evaluate(n *network, u utilization) {
+	if n.Container || n.Sparse() {
+		return
+	}
+
+	a.Lock()
+	if a.states == nil {
+		a.states = make(map[string]*alertState)
+	}
+	if n.Thresholds == (thresholds{}) {
+		delete(a.states, n.Name)
+		a.Unlock()
+		return
+	}
+	state, ok := a.states[n.Name]
+	if !ok {
+		state = &alertState{Network: n.Name, Level: levelOK, Since: time.Now()}
+		a.states[n.Name] = state
+	}
+
+	level := n.Thresholds.level(u.UsedPercent)
+	if levelRank[level] < levelRank[state.Level] {
+		// stay at the current level until it is left by the hysteresis
+		if held := n.Thresholds.level(u.UsedPercent + a.Hysteresis); levelRank[held] > levelRank[level] {
+			level = held
+			if levelRank[level] > levelRank[state.Level] {
+				level = state.Level
+			}
+		}
+	}
+
+	state.UsedPercent = u.UsedPercent
+	previous := state.Level
+	if level == previous {
+		a.Unlock()
+		return
+	}
+	state.Level = level
+	state.Since = time.Now()
+	webhooks := a.Webhooks
+	a.Unlock()
+
+	threshold := n.Thresholds.threshold(level)
+	if level == levelOK {
+		threshold = n.Thresholds.threshold(previous)
+	}
+	al := alert{
+		Network:     n.Name,
+		CIDR:        n.CIDR,
+		DC:          n.DC,
+		Level:       level,
+		Previous:    previous,
+		Threshold:   threshold,
+		Utilization: u,
+		Time:        time.Now(),
+	}
+	log.Print(al.Message())
+	for _, h := range webhooks {
+		go func(h webhook) {
+			if err := h.send(al); err != nil {
+				log.Printf("could not send alert about network %s to %v: %v", n.Name, h, err)
+			}
+		}(h)
+	}
+}
+
+// Active returns the networks which are above one of their thresholds.
+func (a *Alerts) Active() []alertState {
+	a.Lock()
+	defer a.Unlock()
+
+	out := []alertState{}
+	for _, state := range a.states {
+		if state.Level != levelOK {
+			out = append(out, *state)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Network < out[j].Network
+	})
+	return out
+}
+
+// webhookResult is the outcome of sending a test alert to a webhook.
+type webhookResult struct {
+	Webhook string `json:"webhook"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Test sends a sample alert about n to all webhooks and waits for them.
+func (a *Alerts) Test(n *network) []webhookResult {
+	a.Lock()
+	webhooks := a.Webhooks
+	a.Unlock()
+
+	critical := n.Thresholds.Critical
+	if critical == 0 {
+		critical = 95
+	}
+	al := alert{
+		Network:   n.Name,
+		CIDR:      n.CIDR,
+		DC:        n.DC,
+		Level:     levelCritical,
+		Previous:  levelWarning,
+		Threshold: critical,
+		Utilization: utilization{
+			Total:       100,
+			Used:        critical,
+			Free:        100 - critical,
+			UsedPercent: critical,
+			FreePercent: 100 - critical,
+		},
+		Time: time.Now(),
+		Test: true,
+	}
+
+	out := make([]webhookResult, len(webhooks))
+	var wg sync.WaitGroup
+	for i, h := range webhooks {
+		out[i].Webhook = h.String()
+		wg.Add(1)
+		go func(i int, h webhook) {
+			defer wg.Done()
+			if err := h.send(al); err != nil {
+				out[i].Error = err.Error()
+			}
+		}(i, h)
+	}
+	wg.Wait()
+	return out
+}
@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestThresholdsLevel(t *testing.T) {
+	tests := []struct {
+		thresholds thresholds
+		used       int
+		want       string
+	}{
+		{thresholds{Warning: 80, Critical: 90}, 0, levelOK},
+		{thresholds{Warning: 80, Critical: 90}, 79, levelOK},
+		{thresholds{Warning: 80, Critical: 90}, 80, levelWarning},
+		{thresholds{Warning: 80, Critical: 90}, 89, levelWarning},
+		{thresholds{Warning: 80, Critical: 90}, 90, levelCritical},
+		{thresholds{Warning: 80, Critical: 90}, 100, levelCritical},
+		{thresholds{Critical: 90}, 85, levelOK},
+		{thresholds{Critical: 90}, 95, levelCritical},
+		{thresholds{Warning: 80}, 100, levelWarning},
+	}
+	for _, tt := range tests {
+		if got := tt.thresholds.level(tt.used); got != tt.want {
+			t.Errorf("%+v.level(%d) = %s, want %s", tt.thresholds, tt.used, got, tt.want)
+		}
+	}
+}
+
+func TestAlertsHysteresis(t *testing.T) {
+	tests := []struct {
+		name  string
+		used  []int
+		level []string
+	}{
+		{
+			name:  "up",
+			used:  []int{50, 80, 90},
+			level: []string{levelOK, levelWarning, levelCritical},
+		},
+		{
+			name:  "straight to critical",
+			used:  []int{95},
+			level: []string{levelCritical},
+		},
+		{
+			name:  "warning held within the hysteresis",
+			used:  []int{82, 79, 76, 75, 80, 74},
+			level: []string{levelWarning, levelWarning, levelWarning, levelWarning, levelWarning, levelOK},
+		},
+		{
+			name:  "critical held within the hysteresis",
+			used:  []int{91, 89, 86, 85, 84},
+			level: []string{levelCritical, levelCritical, levelCritical, levelCritical, levelWarning},
+		},
+		{
+			name:  "critical down to warning",
+			used:  []int{91, 77},
+			level: []string{levelCritical, levelWarning},
+		},
+		{
+			name:  "critical down to ok",
+			used:  []int{91, 60},
+			level: []string{levelCritical, levelOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Alerts{Hysteresis: 5}
+			n := &network{Name: "test", CIDR: "10.0.0.0/24", Thresholds: thresholds{Warning: 80, Critical: 90}}
+			for i, used := range tt.used {
+				a.Evaluate(n, utilization{UsedPercent: used})
+				if got := a.states[n.Name].Level; got != tt.level[i] {
+					t.Errorf("after %v: level %s, want %s", tt.used[:i+1], got, tt.level[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// Allocator decides in which order the free IPs of a network are handed
+// out.
+type Allocator interface {
+	// Order returns the IPs of free in the order they should be allocated.
+	// IPs which must not be allocated at all are left out.
+	Order(n *network, free []net.IP) []net.IP
+	// Walk calls next with host addresses of a network too large to be
+	// expanded, in the order they should be allocated, until next returns
+	// false.
+	Walk(n *network, next func(net.IP) bool)
+}
+
+// allocators holds the known strategies by the name used in netdef.yaml
+// and in reservation requests.
+var allocators = map[string]func(offset int) Allocator{
+	"random":  func(offset int) Allocator { return randomAllocator{} },
+	"lowest":  func(offset int) Allocator { return lowestAllocator{} },
+	"highest": func(offset int) Allocator { return highestAllocator{} },
+	"offset":  func(offset int) Allocator { return offsetAllocator{offset: offset} },
+}
+
+const defaultAllocator = "random"
+
+type allocation struct {
+	Strategy string `yaml:"strategy" json:"strategy"`
+	Offset   int    `yaml:"offset" json:"offset"`
+}
+
+func NewAllocator(strategy string, offset int) (Allocator, error) {
+	if strategy == "" {
+		strategy = defaultAllocator
+	}
+	f, ok := allocators[strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown allocation strategy %q", strategy)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("allocation offset %d is negative", offset)
+	}
+	return f(offset), nil
+}
+
+func sortIPs(ips []net.IP) []net.IP {
+	out := make([]net.IP, len(ips))
+	copy(out, ips)
+	sort.Slice(out, func(i, j int) bool {
+		return compareIP(out[i], out[j]) < 0
+	})
+	return out
+}
+
+type randomAllocator struct{}
+
+func (a randomAllocator) Order(n *network, free []net.IP) []net.IP {
+	out := make([]net.IP, len(free))
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i, j := range random.Perm(len(free)) {
+		out[i] = free[j]
+	}
+	return out
+}
+
+func (a randomAllocator) Walk(n *network, next func(net.IP) bool) {
+	first, last, err := n.Hosts()
+	if err != nil {
+		return
+	}
+	v4 := first.To4() != nil
+	base := ipToInt(first)
+	size := new(big.Int).Sub(ipToInt(last), base)
+	size.Add(size, big.NewInt(1))
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		i := new(big.Int).Rand(random, size)
+		if !next(intToIP(i.Add(i, base), v4)) {
+			return
+		}
+	}
+}
+
+type lowestAllocator struct{}
+
+func (a lowestAllocator) Order(n *network, free []net.IP) []net.IP {
+	return sortIPs(free)
+}
+
+func (a lowestAllocator) Walk(n *network, next func(net.IP) bool) {
+	n.Walk(next)
+}
+
+type highestAllocator struct{}
+
+func (a highestAllocator) Order(n *network, free []net.IP) []net.IP {
+	out := sortIPs(free)
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (a highestAllocator) Walk(n *network, next func(net.IP) bool) {
+	first, last, err := n.Hosts()
+	if err != nil {
+		return
+	}
+	for ip := last; ; ip = prevIP(ip) {
+		if !next(ip) || ip.Equal(first) {
+			return
+		}
+	}
+}
+
+// offsetAllocator allocates the lowest free IP after the first offset host
+// addresses of the network, which are kept for infrastructure.
+type offsetAllocator struct {
+	offset int
+}
+
+func (a offsetAllocator) Order(n *network, free []net.IP) []net.IP {
+	_, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return nil
+	}
+	base := new(big.Int).SetBytes(ipnet.IP.To16())
+	limit := new(big.Int).Add(base, big.NewInt(int64(a.offset)))
+
+	out := []net.IP{}
+	for _, ip := range sortIPs(free) {
+		if new(big.Int).SetBytes(ip.To16()).Cmp(limit) > 0 {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+func (a offsetAllocator) Walk(n *network, next func(net.IP) bool) {
+	_, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return
+	}
+	_, last, err := n.Hosts()
+	if err != nil {
+		return
+	}
+	start := ipToInt(ipnet.IP)
+	start.Add(start, big.NewInt(int64(a.offset)+1))
+	v4 := last.To4() != nil
+	for ip := intToIP(start, v4); compareIP(ip, last) <= 0; ip = nextIP(ip) {
+		if !next(ip) {
+			return
+		}
+	}
+}
+
+// allocateBlock returns count consecutive free IPs, starting at the first
+// IP of order that has enough free successors. If prefix is not 0 the block
+// has to start on a boundary of a network of that prefix length.
+func allocateBlock(order []net.IP, free map[string]bool, count int, prefix int) []net.IP {
+	for _, start := range order {
+		if prefix != 0 && !alignIP(start, prefix).Equal(start) {
+			continue
+		}
+
+		block := []net.IP{start}
+		for ip := start; len(block) < count; {
+			ip = nextIP(ip)
+			if !free[ip.String()] {
+				break
+			}
+			block = append(block, ip)
+		}
+		if len(block) == count {
+			return block
+		}
+	}
+	return nil
+}
+
+// alignIP returns the first address of the network of the given prefix
+// length ip belongs to.
+func alignIP(ip net.IP, prefix int) net.IP {
+	ip = dupIP(ip)
+	return ip.Mask(net.CIDRMask(prefix, 8*len(ip)))
+}
+
+// maxWalk bounds the number of addresses looked at when searching for
+// candidates in a sparse network.
+const maxWalk = 1 << 16
+
+// Candidates walks the address space of a sparse network in the order of
+// the allocator and returns up to want blocks of size consecutive addresses
+// which are not known to be in use. If prefix is not 0, blocks start on a
+// boundary of that prefix length. Addresses which look like SLAAC addresses
+// are never considered.
+func Candidates(n *network, a Allocator, size int, prefix int, want int) detailedIP {
+	known := map[string]bool{}
+	for _, ip := range n.Known() {
+		known[ip.String()] = true
+	}
+
+	out := detailedIP{}
+	usable := func(ip net.IP) bool {
+		if _, taken := out[ip.String()]; taken || known[ip.String()] || isEUI64(ip) {
+			return false
+		}
+		d, ok := n.Details(ip)
+		return ok && d.Unmanaged == ""
+	}
+
+	blocks, walked := 0, 0
+	a.Walk(n, func(start net.IP) bool {
+		walked++
+		if prefix != 0 {
+			start = alignIP(start, prefix)
+		}
+
+		block := []net.IP{}
+		for ip := start; len(block) < size && usable(ip); ip = nextIP(ip) {
+			block = append(block, ip)
+		}
+		if len(block) == size {
+			for _, ip := range block {
+				out[ip.String()] = details{IP: ip}
+			}
+			blocks++
+		}
+		return blocks < want && walked < maxWalk
+	})
+	return out
+}
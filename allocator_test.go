@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func parseIPs(list ...string) []net.IP {
+	out := make([]net.IP, len(list))
+	for i, s := range list {
+		out[i] = net.ParseIP(s)
+	}
+	return out
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = ip.String()
+	}
+	return out
+}
+
+func TestAllocatorOrder(t *testing.T) {
+	n := &network{Name: "test", CIDR: "192.0.2.0/24"}
+	free := parseIPs("192.0.2.20", "192.0.2.3", "192.0.2.11", "192.0.2.200", "192.0.2.10")
+
+	tests := []struct {
+		strategy string
+		offset   int
+		want     []string
+	}{
+		{"lowest", 0, []string{"192.0.2.3", "192.0.2.10", "192.0.2.11", "192.0.2.20", "192.0.2.200"}},
+		{"highest", 0, []string{"192.0.2.200", "192.0.2.20", "192.0.2.11", "192.0.2.10", "192.0.2.3"}},
+		{"offset", 0, []string{"192.0.2.3", "192.0.2.10", "192.0.2.11", "192.0.2.20", "192.0.2.200"}},
+		// the first 10 host addresses are kept
+		{"offset", 10, []string{"192.0.2.11", "192.0.2.20", "192.0.2.200"}},
+		{"offset", 250, []string{}},
+	}
+	for _, tt := range tests {
+		a, err := NewAllocator(tt.strategy, tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ipStrings(a.Order(n, free)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %d: got %v, want %v", tt.strategy, tt.offset, got, tt.want)
+		}
+	}
+
+	// random hands out every free IP once, in any order
+	for _, strategy := range []string{"random", ""} {
+		a, err := NewAllocator(strategy, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ipStrings(a.Order(n, free))
+		sort.Strings(got)
+		want := ipStrings(free)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want a permutation of %v", strategy, got, want)
+		}
+	}
+}
+
+func TestNewAllocatorErrors(t *testing.T) {
+	if _, err := NewAllocator("fastest", 0); err == nil {
+		t.Error("unknown strategy was accepted")
+	}
+	if _, err := NewAllocator("offset", -1); err == nil {
+		t.Error("negative offset was accepted")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unrolled/render"
+)
+
+// identity is the user a request was made by, with the groups it is a
+// member of and the roles it has.
+type identity struct {
+	Name   string    `json:"name"`
+	Groups []string  `json:"groups"`
+	Roles  []binding `json:"roles"`
+}
+
+// anonymous is the identity of all requests while authentication is
+// disabled. It may do everything, like before authentication existed.
+var anonymous = &identity{Groups: []string{}, Roles: []binding{{Role: roleAdmin}}}
+
+// authenticator checks the password of a user, like a htpasswd file or a
+// directory does. It returns false if the user is unknown or the password
+// is wrong, and an error if it could not tell.
+type authenticator interface {
+	Authenticate(user string, password string) (bool, error)
+}
+
+// token is an API token of a user, sent as "Authorization: Bearer <token>".
+type token struct {
+	User  string
+	Token string
+}
+
+// parseTokens reads tokens separated by commas or whitespace, each in the
+// form "<user>=<token>".
+func parseTokens(spec string) ([]token, error) {
+	var out []token
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("invalid token, expected <user>=<token>")
+		}
+		out = append(out, token{User: parts[0], Token: parts[1]})
+	}
+	return out, nil
+}
+
+// htpasswd authenticates users against a htpasswd file, which is read again
+// whenever it changes. Passwords hashed with {SHA}, $apr1$ or $1$ (MD5) are
+// supported. Entries with other hashes like bcrypt or with passwords in
+// plain text are skipped with a warning.
+type htpasswd struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	hashes  map[string]string
+}
+
+// newHtpasswd reads the htpasswd file at path.
+func newHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the file if it changed since it was read last.
+func (h *htpasswd) load() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.hashes != nil && info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	lines := bufio.NewScanner(f)
+	for line := 1; lines.Scan(); line++ {
+		text := strings.TrimSpace(lines.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			log.Printf("%s:%d: expected <user>:<password hash>", h.path, line)
+			continue
+		}
+		if !strings.HasPrefix(parts[1], "$") && !strings.HasPrefix(parts[1], "{") {
+			log.Printf("%s:%d: password of %s is not hashed, skipping it", h.path, line, parts[0])
+			continue
+		}
+		if !supportedHash(parts[1]) {
+			log.Printf("%s:%d: password hash of %s is not supported, use {SHA} or $apr1$", h.path, line, parts[0])
+			continue
+		}
+		hashes[parts[0]] = parts[1]
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+
+	h.hashes = hashes
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	return nil
+}
+
+func supportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "{SHA}") || strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "$1$")
+}
+
+func (h *htpasswd) Authenticate(user string, password string) (bool, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if err := h.load(); err != nil {
+		return false, err
+	}
+	hash, ok := h.hashes[user]
+	if !ok {
+		return false, nil
+	}
+	return checkHash(hash, password), nil
+}
+
+// checkHash reports whether password matches a htpasswd hash. Unsupported
+// hashes never match.
+func checkHash(hash string, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		parts := strings.SplitN(hash, "$", 4)
+		if len(parts) != 4 {
+			return false
+		}
+		computed = md5Crypt(password, parts[2], "$"+parts[1]+"$")
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// md5Crypt hashes password like crypt(3) with MD5, which Apache uses with
+// the magic "$apr1$" instead of "$1$".
+func md5Crypt(password string, salt string, magic string) string {
+	pw := []byte(password)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(password + salt + password))
+	d := md5.New()
+	d.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(alt[:])
+		} else {
+			d.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			d.Write(pw)
+		}
+		sum = d.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	out := []byte(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[g[0]])<<16|uint(sum[g[1]])<<8|uint(sum[g[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+	return string(out)
+}
+
+// Auth authenticates requests with API tokens or with HTTP basic auth
+// against the authenticators, which are asked in turn. Users get their
+// roles from Policy, Admins are admins everywhere and everyone has
+// DefaultRole everywhere, unless it is empty. Authentication is disabled
+// as long as there are neither tokens nor authenticators.
+type Auth struct {
+	Tokens         []token
+	Authenticators []authenticator
+	Admins         map[string]bool
+	Policy         *policy
+	DefaultRole    string
+}
+
+var auth Auth
+
+func (a *Auth) Enabled() bool {
+	return len(a.Tokens) > 0 || len(a.Authenticators) > 0
+}
+
+var errUnauthorized = errors.New("Invalid credentials")
+
+// identify returns the identity of the credentials of req, or nil if
+// there are none.
+func (a *Auth) identify(req *http.Request) (*identity, error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(header, "Bearer ") {
+		given := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		name := ""
+		for _, t := range a.Tokens {
+			if subtle.ConstantTimeCompare(given, []byte(t.Token)) == 1 {
+				name = t.User
+			}
+		}
+		if name == "" {
+			return nil, errUnauthorized
+		}
+		return a.newIdentity(name), nil
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok || user == "" || password == "" {
+		return nil, errUnauthorized
+	}
+	for _, au := range a.Authenticators {
+		ok, err := au.Authenticate(user, password)
+		if err != nil {
+			return nil, fmt.Errorf("could not authenticate %s: %v", user, err)
+		}
+		if ok {
+			return a.newIdentity(user), nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+// newIdentity looks up the groups and roles of an authenticated user.
+func (a *Auth) newIdentity(name string) *identity {
+	id := &identity{Name: name, Groups: []string{}, Roles: []binding{}}
+	if a.Policy != nil {
+		groups, roles := a.Policy.assign(name)
+		id.Groups = append(id.Groups, groups...)
+		id.Roles = append(id.Roles, roles...)
+	}
+	if a.Admins[name] {
+		id.Roles = append(id.Roles, binding{Role: roleAdmin})
+	}
+	if a.DefaultRole != "" {
+		id.Roles = append(id.Roles, binding{Role: a.DefaultRole})
+	}
+	return id
+}
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+// ServeHTTP rejects requests without valid credentials and passes the
+// identity of the others on to the handlers.
+func (a *Auth) ServeHTTP(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if !a.Enabled() {
+		next(res, req)
+		return
+	}
+
+	r := render.New()
+	id, err := a.identify(req)
+	switch {
+	case err == errUnauthorized || (err == nil && id == nil):
+		if len(a.Authenticators) > 0 {
+			res.Header().Add("WWW-Authenticate", `Basic realm="netmgmt"`)
+		}
+		if len(a.Tokens) > 0 {
+			res.Header().Add("WWW-Authenticate", `Bearer realm="netmgmt"`)
+		}
+		message := "Authentication required"
+		if err != nil {
+			message = err.Error()
+		}
+		r.JSON(res, http.StatusUnauthorized, message)
+		return
+	case err != nil:
+		log.Print(err)
+		r.JSON(res, http.StatusServiceUnavailable, "Credentials could not be checked, please retry")
+		return
+	}
+	next(res, req.WithContext(context.WithValue(req.Context(), identityKey, id)))
+}
+
+// currentIdentity returns the identity a request was made by.
+func currentIdentity(req *http.Request) *identity {
+	if id, ok := req.Context().Value(identityKey).(*identity); ok {
+		return id
+	}
+	return anonymous
+}
+
+// mayChange reports whether id may release or extend lock of an IP of n,
+// which only its owner and the network admins of n may.
+func (id *identity) mayChange(lock Lock, n *network) bool {
+	return id.can(roleNetworkAdmin, n) || (lock.Owner != "" && lock.Owner == id.Name)
+}
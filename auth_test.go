@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The hashes below were created with openssl passwd and htpasswd.
+func TestMD5Crypt(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		magic    string
+		want     string
+	}{
+		{"secret", "abcdefgh", "$apr1$", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/"},
+		{"pass123", "xyz", "$1$", "$1$xyz$fjaBlL4FthteQC.VXOjrH1"},
+		{"", "saltsalt", "$1$", "$1$saltsalt$5Jhcit4zN9UlGiA0txPkO0"},
+		// salts are cut off after 8 characters
+		{"password", "longsaltistruncated", "$apr1$", "$apr1$longsalt$l.ixpUD1Nt03B36qgikgr."},
+	}
+	for _, tt := range tests {
+		if got := md5Crypt(tt.password, tt.salt, tt.magic); got != tt.want {
+			t.Errorf("md5Crypt(%q, %q, %q) = %s, want %s", tt.password, tt.salt, tt.magic, got, tt.want)
+		}
+	}
+}
+
+func TestCheckHash(t *testing.T) {
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret", true},
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "Secret", false},
+		{"$1$xyz$fjaBlL4FthteQC.VXOjrH1", "pass123", true},
+		{"$1$xyz$fjaBlL4FthteQC.VXOjrH1", "pass124", false},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret2", false},
+		{"$apr1$broken", "secret", false},
+		// passwords in plain text and bcrypt hashes are not supported
+		{"secret", "secret", false},
+		{"$2y$05$zr9AeeJbKYFmkY7SN9Ch6.p9ETCh6eERbTQSAmXk6.9gvtOZpRxdu", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := checkHash(tt.hash, tt.password); got != tt.want {
+			t.Errorf("checkHash(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	data := `# users
+alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/
+bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+carol:secret
+dave:$2y$05$zr9AeeJbKYFmkY7SN9Ch6.p9ETCh6eERbTQSAmXk6.9gvtOZpRxdu
+broken
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", true},
+		{"carol", "secret", false},
+		{"dave", "secret", false},
+		{"eve", "secret", false},
+	}
+	for _, tt := range tests {
+		ok, err := h.Authenticate(tt.user, tt.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.user, tt.password, ok, tt.want)
+		}
+	}
+	if len(h.hashes) != 2 {
+		t.Errorf("loaded %d entries, want 2", len(h.hashes))
+	}
+}
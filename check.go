@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net"
 	"sync"
 	"time"
@@ -10,31 +12,69 @@ import (
 )
 
 type ResultSet struct {
-	IP           net.IP `json:"ip"`
-	Name         string `json:"name"`
-	ReverseRec   net.IP `json:"reverse_rec"`
-	Desc         string `json:"desc"`
-	Pingable     bool   `json:"pingable"`
-	Lock         Lock   `json:"lock"`
-	Free         bool   `json:"free"`
-	ForeignRange string `json:"foreign_range"`
-	Unmanaged    string `json:"unmanaged"`
+	IP           net.IP    `json:"ip"`
+	Name         string    `json:"name"`
+	ReverseRec   net.IP    `json:"reverse_rec"`
+	Desc         string    `json:"desc"`
+	Pingable     bool      `json:"pingable"`
+	Lock         Lock      `json:"lock"`
+	Free         bool      `json:"free"`
+	ForeignRange string    `json:"foreign_range"`
+	Unmanaged    string    `json:"unmanaged"`
+	MAC          string    `json:"mac,omitempty"`
+	LastSeen     time.Time `json:"last_seen"`
 }
 
 func (rs ResultSet) Used() bool {
 	return rs.Pingable || rs.Name != "" || rs.Lock.Locked()
 }
 
+// Conflict describes why the IP cannot be reserved. It returns an empty
+// string if the IP is free.
+func (rs ResultSet) Conflict() string {
+	switch {
+	case rs.Unmanaged != "":
+		return fmt.Sprintf("%v is not managed: %s", rs.IP, rs.Unmanaged)
+	case rs.Lock.Locked():
+		return fmt.Sprintf("%v is already reserved", rs.IP)
+	case rs.Pingable:
+		return fmt.Sprintf("%v answers to ping", rs.IP)
+	case rs.Name != "":
+		return fmt.Sprintf("%v has a PTR record pointing to %s", rs.IP, rs.Name)
+	}
+	return ""
+}
+
 type check struct {
 	sync.RWMutex
 	results     map[string]*ResultSet
 	utilization utilization
+	// zones are used to resolve the IPs instead of DNS queries, if set
+	zones zoneSet
+	dns   dnsLookup
+	// incomplete is set if the checks did not finish in time, IPs may
+	// then look free although they are not. unchecked holds the IPs which
+	// could not be resolved or pinged.
+	incomplete bool
+	unchecked  map[string]bool
+	// unresolved holds the IPs whose lookup failed, their names are unknown
+	unresolved map[string]bool
+	// dnsErrors is the number of IPs which could not be resolved, pinged
+	// the number of IPs pinged and pingReplies the number which answered
+	dnsErrors   int
+	pinged      int
+	pingReplies int
 }
 
-func NewCheck(ips detailedIP) *check {
+// checkTimeout is the time the live checks of a request may take.
+var checkTimeout = 20 * time.Second
+
+func NewCheck(n *network, ips detailedIP) *check {
 	var c check
+	c.dns = n.Lookup()
 	c.results = make(map[string]*ResultSet)
 	c.utilization = utilization{}
+	c.unchecked = make(map[string]bool)
 	for ip, details := range ips {
 		res := ResultSet{
 			IP:           details.IP,
@@ -46,47 +86,118 @@ func NewCheck(ips detailedIP) *check {
 			ForeignRange: "",
 			Unmanaged:    details.Unmanaged,
 		}
+		if mac := eui64MAC(details.IP); mac != nil {
+			res.MAC = mac.String()
+		}
 		c.results[ip] = &res
 
 	}
 	return &c
 }
 
-func (c *check) isResolvable() {
+func (c *check) isResolvable(ctx context.Context) {
 	r := NewResolver()
-	for ip, _ := range c.results {
+	r.DNS = c.dns
+	pending := make(map[string]bool)
+	for ip, res := range c.results {
+		if resp, ok := c.zones.resolve(ctx, c.dns, res.IP); ok {
+			if resp != nil {
+				res.Name = resp.PTR
+				res.Desc = resp.TXT
+				res.ReverseRec = resp.A
+			}
+			continue
+		}
 		r.AddAddr(ip)
+		pending[ip] = true
 	}
 	r.OnRecv = func(resp []*Response) {
 		if len(resp) > 0 {
 			c.Lock()
-			c.results[resp[0].Addr.String()].Name = resp[0].PTR
-			c.results[resp[0].Addr.String()].Desc = resp[0].TXT
-			c.results[resp[0].Addr.String()].ReverseRec = resp[0].A
+			if r, ok := c.results[resp[0].Addr.String()]; ok {
+				r.Name = resp[0].PTR
+				r.Desc = resp[0].TXT
+				r.ReverseRec = resp[0].A
+			}
 			c.Unlock()
 		}
 	}
 	r.OnIdle = func() {}
-	err := r.Run()
+	r.OnDone = func(addr string, err error) {
+		if e, ok := err.(*net.DNSError); err == nil || (ok && e.IsNotFound) {
+			c.Lock()
+			delete(pending, addr)
+			c.Unlock()
+		}
+	}
+	err := r.Run(ctx)
+	c.dnsErrors = r.Failures
 	if err != nil {
 		fmt.Println(err)
+		c.incomplete = true
+	}
+	for ip := range pending {
+		c.unchecked[ip] = true
 	}
+	c.unresolved = pending
 }
 
-func (c *check) isPingable() {
+func (c *check) isPingable(ctx context.Context) {
+	if ctx.Err() != nil {
+		for ip := range c.results {
+			c.unchecked[ip] = true
+		}
+		return
+	}
 	p := fastping.NewPinger()
 	for ip, _ := range c.results {
 		p.AddIP(ip)
+		c.pinged++
 	}
 	p.OnRecv = func(addr *net.IPAddr, rtt time.Duration) {
 		c.Lock()
-		c.results[addr.String()].Pingable = true
+		// use the bare IP, replies from link-local IPv6 addresses carry a zone
+		if r, ok := c.results[addr.IP.String()]; ok && !r.Pingable {
+			r.Pingable = true
+			c.pingReplies++
+		}
 		c.Unlock()
 	}
-	p.OnIdle = func() {}
-	err := p.Run()
-	if err != nil {
-		fmt.Println(err)
+	// run a single round, unless ctx is done first
+	idle := make(chan struct{}, 1)
+	p.OnIdle = func() {
+		select {
+		case idle <- struct{}{}:
+		default:
+		}
+	}
+	p.RunLoop()
+	timedOut := false
+	select {
+	case <-idle:
+	case <-p.Done():
+	case <-ctx.Done():
+		timedOut = true
+	}
+	p.Stop()
+	if err := p.Err(); err != nil {
+		// without ping, e.g. when raw sockets may not be opened, IPs are
+		// only checked with DNS
+		log.Printf("ping failed, checking with DNS only: %v", err)
+		c.Lock()
+		c.pinged, c.pingReplies = 0, 0
+		c.Unlock()
+		return
+	}
+	if timedOut {
+		// IPs which did not answer yet may still do so
+		c.Lock()
+		for ip, r := range c.results {
+			if !r.Pingable {
+				c.unchecked[ip] = true
+			}
+		}
+		c.Unlock()
 	}
 }
 
@@ -99,6 +210,16 @@ func (c *check) isLocked() {
 	}
 }
 
+func (c *check) isSeen() {
+	for ip, r := range c.results {
+		if h, ok := history.Get(ip); ok {
+			c.Lock()
+			r.LastSeen = h.LastSeen
+			c.Unlock()
+		}
+	}
+}
+
 func (c *check) isForeign() {
 	//	for ip, r := range c.results {
 	//		c.Lock()
@@ -126,14 +247,21 @@ func (c *check) getFree() {
 	c.utilization.Total = total
 	c.utilization.Used = used
 	c.utilization.Free = free
-	c.utilization.UsedPercent = used * 100 / total
-	c.utilization.FreePercent = free * 100 / total
+	if total > 0 {
+		c.utilization.UsedPercent = used * 100 / total
+		c.utilization.FreePercent = free * 100 / total
+	}
 }
 
-func (c *check) Run() {
-	c.isResolvable()
-	c.isPingable()
+// Run runs all checks. If ctx is done before, the check is flagged as
+// incomplete.
+func (c *check) Run(ctx context.Context) {
+	c.isResolvable(ctx)
+	c.isPingable(ctx)
 	c.isLocked()
 	c.isForeign()
 	c.getFree()
+	if ctx.Err() != nil {
+		c.incomplete = true
+	}
 }
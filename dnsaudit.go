@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Issue codes reported by the DNS audit.
+const (
+	IssueMultiplePTR   = "MULTIPLE_PTR"
+	IssuePTRCNAME      = "PTR_CNAME"
+	IssuePTRUnresolved = "PTR_UNRESOLVED"
+	IssuePTRMismatch   = "PTR_A_MISMATCH"
+	IssueOutsideDomain = "OUTSIDE_DOMAIN"
+)
+
+// auditWorkers is the number of IPs audited in parallel.
+const auditWorkers = 16
+
+type dnsIssue struct {
+	Code    string `json:"code"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+type dnsAudit struct {
+	IP     string     `json:"ip"`
+	Names  []string   `json:"names"`
+	Issues []dnsIssue `json:"issues"`
+}
+
+// auditIP compares the PTR records of ip with the forward records of the
+// names they point to, resolved with dns. If domain is not empty, names have
+// to be part of it.
+func auditIP(ctx context.Context, dns dnsLookup, ip net.IP, domain string) dnsAudit {
+	a := dnsAudit{IP: ip.String(), Names: []string{}, Issues: []dnsIssue{}}
+
+	names, err := dns.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return a
+	}
+	a.Names = names
+
+	if len(names) > 1 {
+		a.Issues = append(a.Issues, dnsIssue{
+			Code:    IssueMultiplePTR,
+			Message: fmt.Sprintf("%d PTR records found", len(names)),
+		})
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for _, name := range names {
+		fqdn := strings.ToLower(name)
+		if !strings.HasSuffix(fqdn, ".") {
+			fqdn += "."
+		}
+
+		if domain != "" && !strings.HasSuffix(fqdn, "."+domain+".") {
+			a.Issues = append(a.Issues, dnsIssue{
+				Code:    IssueOutsideDomain,
+				Name:    name,
+				Message: fmt.Sprintf("%s is not part of %s", name, domain),
+			})
+		}
+
+		if cname, err := dns.LookupCNAME(ctx, fqdn); err == nil && !strings.EqualFold(cname, fqdn) {
+			a.Issues = append(a.Issues, dnsIssue{
+				Code:    IssuePTRCNAME,
+				Name:    name,
+				Message: fmt.Sprintf("%s is a CNAME for %s", name, cname),
+			})
+		}
+
+		addrs, err := dns.LookupHost(ctx, fqdn)
+		if err != nil {
+			a.Issues = append(a.Issues, dnsIssue{
+				Code:    IssuePTRUnresolved,
+				Name:    name,
+				Message: fmt.Sprintf("%s does not resolve: %v", name, err),
+			})
+			continue
+		}
+
+		found := false
+		for _, addr := range addrs {
+			if ip.Equal(net.ParseIP(addr)) {
+				found = true
+			}
+		}
+		if !found {
+			a.Issues = append(a.Issues, dnsIssue{
+				Code:    IssuePTRMismatch,
+				Name:    name,
+				Message: fmt.Sprintf("%s resolves to %s", name, strings.Join(addrs, ", ")),
+			})
+		}
+	}
+	return a
+}
+
+// auditNetwork audits all IPs of a network which had a PTR record in the
+// latest scan and returns the ones with issues. It stops when ctx is done,
+// returning the IPs audited until then.
+func auditNetwork(ctx context.Context, n *network) ([]dnsAudit, error) {
+	sc, err := scanner.Latest(n)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make(chan net.IP)
+	go func() {
+		defer close(ips)
+		for _, r := range sc.fresh().results {
+			if r.Name == "" {
+				continue
+			}
+			select {
+			case ips <- r.IP:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	dns := n.Lookup()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	out := []dnsAudit{}
+	for i := 0; i < auditWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range ips {
+				a := auditIP(ctx, dns, ip, n.Domain)
+				if ctx.Err() != nil {
+					// lookups failed because of the deadline
+					continue
+				}
+				if len(a.Issues) > 0 {
+					mu.Lock()
+					out = append(out, a)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(out, func(i, j int) bool {
+		return compareIP(net.ParseIP(out[i].IP), net.ParseIP(out[j].IP)) < 0
+	})
+	return out, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheTTL is the longest time a response is cached, regardless of its
+// TTL.
+const maxCacheTTL = 24 * time.Hour
+
+// cacheEntry is a cached response to a query for a name and type, sent to
+// a list of servers or to the resolver of the system. Negative entries
+// cache that the name or the type does not exist.
+type cacheEntry struct {
+	Servers  string    `json:"servers"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Records  []string  `json:"records"`
+	Negative bool      `json:"negative"`
+	Expires  time.Time `json:"expires"`
+	TTL      int       `json:"ttl"`
+	rrs      []dnsRR
+	err      error
+}
+
+// DNSCache caches DNS responses until their TTL expires, so that scans do
+// not query the same records over and over again.
+type DNSCache struct {
+	sync.Mutex
+	// Size is the maximum number of entries, 0 disables the cache.
+	// SystemTTL is the time results of the resolver of the system are
+	// cached, as it does not tell the TTLs of the records.
+	Size      int
+	SystemTTL time.Duration
+	entries   map[string]*cacheEntry
+	hits      uint64
+	misses    uint64
+}
+
+var dnsCache = DNSCache{
+	Size:      100000,
+	SystemTTL: time.Minute,
+}
+
+const noCacheKey contextKey = 1
+
+// withoutCache returns a context in which DNS queries are sent even if the
+// response is cached, for checks which have to see the current records.
+// The responses are cached nevertheless.
+func withoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey, true)
+}
+
+// cacheBypassed reports whether ctx was created by withoutCache.
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(noCacheKey).(bool)
+	return bypass
+}
+
+func cacheKey(servers string, name string, typ string) string {
+	return servers + " " + strings.ToLower(fqdn(name)) + " " + typ
+}
+
+func (c *DNSCache) get(servers string, name string, typ string) (*cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[cacheKey(servers, name, typ)]
+	if !ok || time.Now().After(e.Expires) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return e, true
+}
+
+// put caches e for ttl.
+func (c *DNSCache) put(e *cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	e.Expires = time.Now().Add(ttl)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Size <= 0 {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	if len(c.entries) >= c.Size {
+		c.purge()
+		if len(c.entries) >= c.Size {
+			return
+		}
+	}
+	c.entries[cacheKey(e.Servers, e.Name, e.Type)] = e
+}
+
+// purge removes the expired entries.
+func (c *DNSCache) purge() {
+	now := time.Now()
+	for key, e := range c.entries {
+		if now.After(e.Expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// dnsCacheStats describes the content of the cache.
+type dnsCacheStats struct {
+	Size    int          `json:"size"`
+	Hits    uint64       `json:"hits"`
+	Misses  uint64       `json:"misses"`
+	Entries []cacheEntry `json:"entries"`
+}
+
+// Stats returns the entries which did not expire yet, only those of name
+// if it is not empty.
+func (c *DNSCache) Stats(name string) dnsCacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	c.purge()
+	stats := dnsCacheStats{
+		Size:    len(c.entries),
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: []cacheEntry{},
+	}
+	now := time.Now()
+	for _, e := range c.entries {
+		if name != "" && !strings.EqualFold(e.Name, fqdn(name)) {
+			continue
+		}
+		out := *e
+		out.TTL = int(e.Expires.Sub(now).Seconds())
+		stats.Entries = append(stats.Entries, out)
+	}
+	sort.Slice(stats.Entries, func(i, j int) bool {
+		a, b := stats.Entries[i], stats.Entries[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Servers < b.Servers
+	})
+	return stats
+}
+
+// Flush removes the entries of name, or all entries if name is empty, and
+// returns how many were removed.
+func (c *DNSCache) Flush(name string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	if name == "" {
+		n := len(c.entries)
+		c.entries = nil
+		return n
+	}
+	n := 0
+	for key, e := range c.entries {
+		if strings.EqualFold(e.Name, fqdn(name)) {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// responseTTL returns how long a response may be cached: the lowest TTL of
+// its answers, or for negative responses the TTL of the SOA record in the
+// authority section (RFC 2308). Negative responses without one are not
+// cached.
+func responseTTL(resp *dnsMsg) time.Duration {
+	if len(resp.Answer) == 0 || resp.Rcode() == rcodeNameError {
+		for _, rr := range resp.Authority {
+			if rr.Type == typeSOA {
+				ttl := rr.TTL
+				if min := rr.Minimum(); min < ttl {
+					ttl = min
+				}
+				return time.Duration(ttl) * time.Second
+			}
+		}
+		return 0
+	}
+
+	ttl := resp.Answer[0].TTL
+	for _, rr := range resp.Answer {
+		if rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// systemDNS resolves with the resolver of the system and caches the
+// results for dnsCache.SystemTTL.
+type systemDNS struct{}
+
+// systemServers is how results of the resolver of the system are listed in
+// the cache.
+const systemServers = "system"
+
+func systemLookup(ctx context.Context, typ string, name string, lookup func() ([]string, error)) ([]string, error) {
+	if !cacheBypassed(ctx) {
+		if e, ok := dnsCache.get(systemServers, name, typ); ok {
+			return e.Records, e.err
+		}
+	}
+
+	values, err := lookup()
+	if e, ok := err.(*net.DNSError); err != nil && !(ok && e.IsNotFound) {
+		// only cache that a name does not exist, not failures
+		return values, err
+	}
+	dnsCache.put(&cacheEntry{
+		Servers:  systemServers,
+		Name:     fqdn(name),
+		Type:     typ,
+		Records:  values,
+		Negative: err != nil,
+		err:      err,
+	}, dnsCache.SystemTTL)
+	return values, err
+}
+
+func (systemDNS) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	name := addr
+	if ip := net.ParseIP(addr); ip != nil {
+		name = reverseName(ip)
+	}
+	return systemLookup(ctx, "PTR", name, func() ([]string, error) {
+		return net.DefaultResolver.LookupAddr(ctx, addr)
+	})
+}
+
+func (systemDNS) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return systemLookup(ctx, "A/AAAA", host, func() ([]string, error) {
+		return net.DefaultResolver.LookupHost(ctx, host)
+	})
+}
+
+func (systemDNS) LookupCNAME(ctx context.Context, host string) (string, error) {
+	values, err := systemLookup(ctx, "CNAME", host, func() ([]string, error) {
+		cname, err := net.DefaultResolver.LookupCNAME(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return []string{cname}, nil
+	})
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
+func (systemDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return systemLookup(ctx, "TXT", name, func() ([]string, error) {
+		return net.DefaultResolver.LookupTXT(ctx, name)
+	})
+}
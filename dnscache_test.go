@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// negativeSOA creates the SOA record of a negative response.
+func negativeSOA(ttl uint32, minimum uint32) dnsRR {
+	rr := soaRR("example.com.", 1)
+	rr.TTL = ttl
+	binary.BigEndian.PutUint32(rr.Data[18:], minimum)
+	return rr
+}
+
+func TestResponseTTL(t *testing.T) {
+	a := func(ttl uint32) dnsRR { return addressRR("host.example.com.", net.ParseIP("192.0.2.1"), ttl) }
+	tests := []struct {
+		name string
+		resp dnsMsg
+		want time.Duration
+	}{
+		{"lowest TTL of the answers", dnsMsg{Answer: []dnsRR{a(300), a(60), a(600)}}, time.Minute},
+		{"no data", dnsMsg{Authority: []dnsRR{negativeSOA(3600, 900)}}, 15 * time.Minute},
+		{"name error", dnsMsg{Flags: rcodeNameError, Authority: []dnsRR{negativeSOA(300, 900)}}, 5 * time.Minute},
+		{"negative without SOA", dnsMsg{Flags: rcodeNameError}, 0},
+	}
+	for _, tt := range tests {
+		if got := responseTTL(&tt.resp); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	c := DNSCache{Size: 2}
+	if _, ok := c.get("ns1", "host.example.com.", "A"); ok {
+		t.Fatal("empty cache returned an entry")
+	}
+
+	c.put(&cacheEntry{Servers: "ns1", Name: "host.example.com.", Type: "A", Records: []string{"192.0.2.1"}}, time.Minute)
+	// names are compared regardless of case and of the trailing dot
+	if e, ok := c.get("ns1", "HOST.example.com", "A"); !ok || e.Records[0] != "192.0.2.1" {
+		t.Errorf("get = %+v, %v", e, ok)
+	}
+	if _, ok := c.get("ns2", "host.example.com.", "A"); ok {
+		t.Error("the entry of other servers was returned")
+	}
+	if _, ok := c.get("ns1", "host.example.com.", "AAAA"); ok {
+		t.Error("the entry of another type was returned")
+	}
+
+	// responses with a TTL of 0 are not cached
+	c.put(&cacheEntry{Servers: "ns1", Name: "zero.example.com.", Type: "A"}, 0)
+	if _, ok := c.get("ns1", "zero.example.com.", "A"); ok {
+		t.Error("a response with a TTL of 0 was cached")
+	}
+
+	c.put(&cacheEntry{Servers: "ns1", Name: "old.example.com.", Type: "A"}, time.Minute)
+	c.entries[cacheKey("ns1", "old.example.com.", "A")].Expires = time.Now().Add(-time.Second)
+	if _, ok := c.get("ns1", "old.example.com.", "A"); ok {
+		t.Error("an expired entry was returned")
+	}
+
+	// the cache is full, expired entries make room
+	c.put(&cacheEntry{Servers: "ns1", Name: "new.example.com.", Type: "A"}, time.Minute)
+	if _, ok := c.get("ns1", "new.example.com.", "A"); !ok {
+		t.Error("the expired entry did not make room")
+	}
+	c.put(&cacheEntry{Servers: "ns1", Name: "more.example.com.", Type: "A"}, time.Minute)
+	if _, ok := c.get("ns1", "more.example.com.", "A"); ok {
+		t.Error("an entry was added to the full cache")
+	}
+
+	stats := c.Stats("")
+	if stats.Size != 2 || stats.Hits != 2 || stats.Misses != 6 {
+		t.Errorf("stats = %+v, want 2 entries, 2 hits and 6 misses", stats)
+	}
+	if stats := c.Stats("new.example.com"); len(stats.Entries) != 1 || stats.Entries[0].TTL <= 0 {
+		t.Errorf("entries of new.example.com = %+v", stats.Entries)
+	}
+	if n := c.Flush("NEW.example.com."); n != 1 {
+		t.Errorf("Flush removed %d entries, want 1", n)
+	}
+	if n := c.Flush(""); n != 1 || len(c.Stats("").Entries) != 0 {
+		t.Errorf("Flush removed %d entries, want all 1", n)
+	}
+
+	disabled := DNSCache{}
+	disabled.put(&cacheEntry{Servers: "ns1", Name: "host.example.com.", Type: "A"}, time.Minute)
+	if _, ok := disabled.get("ns1", "host.example.com.", "A"); ok {
+		t.Error("a cache of size 0 cached a response")
+	}
+}
+
+// fakeDNS answers A queries for host.example.com. and NXDOMAIN for other
+// names, and counts the queries it receives.
+type fakeDNS struct {
+	sync.Mutex
+	conn    net.PacketConn
+	queries int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDNS{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeDNS) serve() {
+	b := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		query, err := unpackMsg(b[:n])
+		if err != nil || len(query.Question) != 1 {
+			continue
+		}
+		s.Lock()
+		s.queries++
+		s.Unlock()
+
+		resp := &dnsMsg{ID: query.ID, Flags: flagQR, Question: query.Question}
+		if q := query.Question[0]; q.Name == "host.example.com." && q.Type == typeA {
+			resp.Answer = []dnsRR{addressRR(q.Name, net.ParseIP("192.0.2.1"), 300)}
+		} else {
+			resp.Flags |= rcodeNameError
+			resp.Authority = []dnsRR{negativeSOA(300, 300)}
+		}
+		out, err := resp.pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(out, addr)
+	}
+}
+
+func (s *fakeDNS) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries
+}
+
+func TestDNSClientCache(t *testing.T) {
+	dnsCache.Flush("")
+	t.Cleanup(func() { dnsCache.Flush("") })
+	s := newFakeDNS(t)
+	c := &dnsClient{Servers: []string{s.conn.LocalAddr().String()}, Timeout: time.Second}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		rrs, err := c.query(ctx, "host.example.com", typeA)
+		if err != nil || len(rrs) != 1 {
+			t.Fatalf("query = %v, %v", rrs, err)
+		}
+	}
+	if n := s.count(); n != 1 {
+		t.Errorf("%d queries were sent, want 1", n)
+	}
+
+	// negative responses are cached as well
+	for i := 0; i < 2; i++ {
+		_, err := c.query(ctx, "missing.example.com", typeA)
+		if e, ok := err.(*net.DNSError); !ok || !e.IsNotFound {
+			t.Fatalf("query of a missing name = %v", err)
+		}
+	}
+	if n := s.count(); n != 2 {
+		t.Errorf("%d queries were sent, want 2", n)
+	}
+
+	// checks bypass the cache
+	if _, err := c.query(withoutCache(ctx), "host.example.com", typeA); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count(); n != 3 {
+		t.Errorf("%d queries were sent, want 3", n)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dnsLookup resolves names and addresses, like net.Resolver.
+type dnsLookup interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// dnsSettings configures the DNS servers used to resolve the IPs of
+// networks which have no DNS servers of their own, and how many IPs are
+// resolved in parallel and for how long.
+type dnsSettings struct {
+	DC            map[string][]string
+	Timeout       time.Duration
+	Retries       int
+	Workers       int
+	LookupTimeout time.Duration
+}
+
+var dnsConfig = dnsSettings{
+	Timeout:       2 * time.Second,
+	Retries:       2,
+	Workers:       64,
+	LookupTimeout: 10 * time.Second,
+}
+
+// parseDCServers reads the DNS servers of data centers in the form
+// "<dc>=<server>,<server>;<dc>=<server>".
+func parseDCServers(spec string) (map[string][]string, error) {
+	out := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid DNS servers %q, expected <dc>=<server>,<server>", entry)
+		}
+		for _, server := range strings.Split(parts[1], ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				out[parts[0]] = append(out[parts[0]], withPort(server))
+			}
+		}
+	}
+	return out, nil
+}
+
+// ednsSize is the UDP payload size announced with EDNS. It avoids
+// fragmentation, larger responses are retried over TCP.
+const ednsSize = 1232
+
+// dnsClient resolves by querying a list of DNS servers. A query is sent to
+// the servers in order until one answers, and the whole list is tried
+// again for every retry.
+type dnsClient struct {
+	Servers []string
+	Timeout time.Duration
+	Retries int
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// ask sends a single query for name to server.
+func (c *dnsClient) ask(server string, name string, typ uint16, edns bool, timeout time.Duration) (*dnsMsg, error) {
+	m := &dnsMsg{
+		ID:       newMsgID(),
+		Flags:    flagRD,
+		Question: []dnsQuestion{{Name: name, Type: typ, Class: classINET}},
+	}
+	if edns {
+		m.Additional = []dnsRR{optRR(ednsSize)}
+	}
+	return send(server, nil, m, timeout)
+}
+
+// query returns the answer section of the response to a query for name.
+// Responses are cached for their TTL, unless ctx bypasses the cache. No
+// query is sent past the deadline of ctx.
+func (c *dnsClient) query(ctx context.Context, name string, typ uint16) ([]dnsRR, error) {
+	name = fqdn(name)
+	servers := strings.Join(c.Servers, ",")
+	if !cacheBypassed(ctx) {
+		if e, ok := dnsCache.get(servers, name, typeName(typ)); ok {
+			return e.rrs, e.err
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		for _, server := range c.Servers {
+			if err := ctx.Err(); err != nil {
+				return nil, &net.DNSError{Err: err.Error(), Name: name, IsTimeout: true}
+			}
+			timeout := c.Timeout
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+				timeout = time.Until(deadline)
+			}
+
+			resp, err := c.ask(server, name, typ, true, timeout)
+			if err == nil && resp.Rcode() == rcodeFormatError {
+				// an old server not supporting EDNS
+				resp, err = c.ask(server, name, typ, false, timeout)
+			}
+			if err != nil {
+				lastErr = &net.DNSError{Err: err.Error(), Name: name, Server: server, IsTimeout: isTimeout(err)}
+				continue
+			}
+
+			e := &cacheEntry{Servers: servers, Name: name, Type: typeName(typ)}
+			switch resp.Rcode() {
+			case rcodeSuccess:
+				e.rrs = resp.Answer
+				e.Records = []string{}
+				for _, rr := range resp.Answer {
+					e.Records = append(e.Records, rr.String())
+				}
+				e.Negative = len(resp.Answer) == 0
+				dnsCache.put(e, responseTTL(resp))
+				return e.rrs, nil
+			case rcodeNameError:
+				e.err = notFound(name)
+				e.Negative = true
+				dnsCache.put(e, responseTTL(resp))
+				return nil, e.err
+			}
+			lastErr = &net.DNSError{Err: rcodeError(resp.Rcode()).Error(), Name: name, Server: server}
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no DNS servers configured")
+	}
+	return nil, lastErr
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// follow returns the name the CNAMEs of name in rrs lead to.
+func follow(rrs []dnsRR, name string) string {
+	name = fqdn(name)
+	for hops := 0; hops < 8; hops++ {
+		found := false
+		for _, rr := range rrs {
+			if rr.Type == typeCNAME && strings.EqualFold(rr.Name, name) {
+				name = rr.Target()
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+func (c *dnsClient) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	rrs, err := c.query(ctx, reverseName(ip), typePTR)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, rr := range rrs {
+		if rr.Type == typePTR {
+			names = append(names, rr.Target())
+		}
+	}
+	if len(names) == 0 {
+		return nil, notFound(addr)
+	}
+	return names, nil
+}
+
+func (c *dnsClient) LookupHost(ctx context.Context, host string) ([]string, error) {
+	var addrs []string
+	var lastErr error
+	for _, typ := range []uint16{typeA, typeAAAA} {
+		rrs, err := c.query(ctx, host, typ)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range rrs {
+			if ip := rr.IP(); ip != nil {
+				addrs = append(addrs, ip.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, notFound(host)
+	}
+	return addrs, nil
+}
+
+func (c *dnsClient) LookupCNAME(ctx context.Context, host string) (string, error) {
+	rrs, err := c.query(ctx, host, typeA)
+	if err != nil {
+		return "", err
+	}
+	return follow(rrs, host), nil
+}
+
+func (c *dnsClient) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, err := c.query(ctx, name, typeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, rr := range rrs {
+		if rr.Type == typeTXT {
+			txts = append(txts, rr.TXT())
+		}
+	}
+	return txts, nil
+}
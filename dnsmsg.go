@@ -0,0 +1,851 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements the parts of the DNS wire format (RFC 1035) needed
+// to look up names, to send dynamic updates (RFC 2136) and to transfer
+// zones (RFC 5936, RFC 1995), signed with TSIG (RFC 8945).
+
+const (
+	typeA     uint16 = 1
+	typeNS    uint16 = 2
+	typeCNAME uint16 = 5
+	typeSOA   uint16 = 6
+	typePTR   uint16 = 12
+	typeTXT   uint16 = 16
+	typeAAAA  uint16 = 28
+	typeOPT   uint16 = 41
+	typeTSIG  uint16 = 250
+	typeIXFR  uint16 = 251
+	typeAXFR  uint16 = 252
+
+	classINET uint16 = 1
+	classNONE uint16 = 254
+	classANY  uint16 = 255
+
+	opcodeUpdate = 5
+
+	flagQR = 1 << 15
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+
+	rcodeSuccess     = 0
+	rcodeFormatError = 1
+	rcodeNameError   = 3
+)
+
+var rcodeNames = map[int]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+}
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// dnsRR is a resource record. Names within Data are always stored
+// uncompressed.
+type dnsRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+type dnsMsg struct {
+	ID         uint16
+	Flags      uint16
+	Question   []dnsQuestion
+	Answer     []dnsRR
+	Authority  []dnsRR
+	Additional []dnsRR
+
+	// raw is the message as received and tsigAt the offset of its TSIG
+	// record, or 0 if it is not signed
+	raw    []byte
+	tsigAt int
+}
+
+func (m *dnsMsg) Rcode() int {
+	return int(m.Flags & 0xf)
+}
+
+func rcodeError(rcode int) error {
+	name, ok := rcodeNames[rcode]
+	if !ok {
+		name = fmt.Sprintf("RCODE%d", rcode)
+	}
+	return fmt.Errorf("DNS server responded with %s", name)
+}
+
+// fqdn returns name with a trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// reverseName returns the name of the PTR record of ip, in in-addr.arpa for
+// IPv4 and in ip6.arpa for IPv6.
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	b := make([]byte, 0, 4*net.IPv6len+len("ip6.arpa."))
+	for i := len(ip6) - 1; i >= 0; i-- {
+		b = append(b, hex[ip6[i]&0xf], '.', hex[ip6[i]>>4], '.')
+	}
+	return string(append(b, "ip6.arpa."...))
+}
+
+func packName(b []byte, name string) ([]byte, error) {
+	name = fqdn(name)
+	if name == "." {
+		return append(b, 0), nil
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// unpackName reads a possibly compressed name at off of msg and returns it
+// together with the offset after it.
+func unpackName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errors.New("invalid DNS name in message")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("invalid DNS name pointer in message")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("invalid DNS label in message")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func (rr dnsRR) pack(b []byte) ([]byte, error) {
+	b, err := packName(b, rr.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	h := b[len(b)-10:]
+	binary.BigEndian.PutUint16(h[0:], rr.Type)
+	binary.BigEndian.PutUint16(h[2:], rr.Class)
+	binary.BigEndian.PutUint32(h[4:], rr.TTL)
+	binary.BigEndian.PutUint16(h[8:], uint16(len(rr.Data)))
+	return append(b, rr.Data...), nil
+}
+
+func unpackRR(msg []byte, off int) (dnsRR, int, error) {
+	var rr dnsRR
+	name, off, err := unpackName(msg, off)
+	if err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(msg) {
+		return rr, 0, errors.New("truncated DNS record")
+	}
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(msg[off:])
+	rr.Class = binary.BigEndian.Uint16(msg[off+2:])
+	rr.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	length := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+length > len(msg) {
+		return rr, 0, errors.New("truncated DNS record data")
+	}
+	end := off + length
+
+	// decompress the names within the data
+	switch rr.Type {
+	case typeCNAME, typePTR, typeNS:
+		target, _, err := unpackName(msg, off)
+		if err != nil {
+			return rr, 0, err
+		}
+		rr.Data, err = packName(nil, target)
+		if err != nil {
+			return rr, 0, err
+		}
+	case typeSOA:
+		mname, n, err := unpackName(msg, off)
+		if err != nil {
+			return rr, 0, err
+		}
+		rname, n, err := unpackName(msg, n)
+		if err != nil {
+			return rr, 0, err
+		}
+		if n+20 > end {
+			return rr, 0, errors.New("truncated SOA record")
+		}
+		rr.Data, _ = packName(nil, mname)
+		rr.Data, _ = packName(rr.Data, rname)
+		rr.Data = append(rr.Data, msg[n:n+20]...)
+	default:
+		rr.Data = append([]byte{}, msg[off:end]...)
+	}
+	return rr, end, nil
+}
+
+// Target returns the name a CNAME, NS or PTR record points to.
+func (rr dnsRR) Target() string {
+	name, _, err := unpackName(rr.Data, 0)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// IP returns the address of an A or AAAA record.
+func (rr dnsRR) IP() net.IP {
+	switch {
+	case rr.Type == typeA && len(rr.Data) == net.IPv4len:
+		return net.IPv4(rr.Data[0], rr.Data[1], rr.Data[2], rr.Data[3])
+	case rr.Type == typeAAAA && len(rr.Data) == net.IPv6len:
+		return dupIP(net.IP(rr.Data))
+	}
+	return nil
+}
+
+// TXT returns the strings of a TXT record, joined together.
+func (rr dnsRR) TXT() string {
+	var s string
+	for b := rr.Data; len(b) > 0 && len(b) > int(b[0]); b = b[1+int(b[0]):] {
+		s += string(b[1 : 1+int(b[0])])
+	}
+	return s
+}
+
+// Serial returns the serial of a SOA record.
+func (rr dnsRR) Serial() uint32 {
+	return rr.soaField(0)
+}
+
+// Minimum returns the TTL of negative responses of a SOA record.
+func (rr dnsRR) Minimum() uint32 {
+	return rr.soaField(4)
+}
+
+// soaField returns the i-th of the numbers following the names of a SOA
+// record.
+func (rr dnsRR) soaField(i int) uint32 {
+	_, n, err := unpackName(rr.Data, 0)
+	if err != nil {
+		return 0
+	}
+	_, n, err = unpackName(rr.Data, n)
+	if err != nil || n+4*i+4 > len(rr.Data) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(rr.Data[n+4*i:])
+}
+
+var typeNames = map[uint16]string{
+	typeA:     "A",
+	typeNS:    "NS",
+	typeCNAME: "CNAME",
+	typeSOA:   "SOA",
+	typePTR:   "PTR",
+	typeTXT:   "TXT",
+	typeAAAA:  "AAAA",
+}
+
+func typeName(typ uint16) string {
+	if name, ok := typeNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", typ)
+}
+
+// String returns the record in the format of zone files.
+func (rr dnsRR) String() string {
+	var data string
+	switch rr.Type {
+	case typeA, typeAAAA:
+		data = rr.IP().String()
+	case typeCNAME, typeNS, typePTR:
+		data = rr.Target()
+	case typeTXT:
+		data = strconv.Quote(rr.TXT())
+	case typeSOA:
+		data = fmt.Sprintf("... %d", rr.Serial())
+	default:
+		data = hex.EncodeToString(rr.Data)
+	}
+	return fmt.Sprintf("%s %d IN %s %s", rr.Name, rr.TTL, typeName(rr.Type), data)
+}
+
+// addressRR creates an A or AAAA record for an IP, ptrRR a PTR record.
+func addressRR(name string, ip net.IP, ttl uint32) dnsRR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return dnsRR{Name: name, Type: typeA, Class: classINET, TTL: ttl, Data: []byte(ip4)}
+	}
+	return dnsRR{Name: name, Type: typeAAAA, Class: classINET, TTL: ttl, Data: []byte(ip.To16())}
+}
+
+func ptrRR(name string, target string, ttl uint32) (dnsRR, error) {
+	data, err := packName(nil, target)
+	return dnsRR{Name: name, Type: typePTR, Class: classINET, TTL: ttl, Data: data}, err
+}
+
+// soaRR creates a SOA record carrying nothing but a serial, as sent in
+// IXFR queries.
+func soaRR(zone string, serial uint32) dnsRR {
+	data := []byte{0, 0, byte(serial >> 24), byte(serial >> 16), byte(serial >> 8), byte(serial)}
+	data = append(data, make([]byte, 16)...)
+	return dnsRR{Name: zone, Type: typeSOA, Class: classINET, Data: data}
+}
+
+// optRR creates the OPT record announcing EDNS (RFC 6891) support with the
+// given UDP payload size.
+func optRR(size uint16) dnsRR {
+	return dnsRR{Name: ".", Type: typeOPT, Class: size}
+}
+
+func (m *dnsMsg) pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.Flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Question)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answer)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)))
+
+	var err error
+	for _, q := range m.Question {
+		if b, err = packName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = append(b, byte(q.Type>>8), byte(q.Type), byte(q.Class>>8), byte(q.Class))
+	}
+	for _, section := range [][]dnsRR{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if b, err = rr.pack(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func unpackMsg(b []byte) (*dnsMsg, error) {
+	if len(b) < 12 {
+		return nil, errors.New("DNS message too short")
+	}
+	m := &dnsMsg{
+		ID:    binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[4:])),
+		int(binary.BigEndian.Uint16(b[6:])),
+		int(binary.BigEndian.Uint16(b[8:])),
+		int(binary.BigEndian.Uint16(b[10:])),
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, n, err := unpackName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+4 > len(b) {
+			return nil, errors.New("truncated DNS question")
+		}
+		m.Question = append(m.Question, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[n:]),
+			Class: binary.BigEndian.Uint16(b[n+2:]),
+		})
+		off = n + 4
+	}
+
+	sections := []*[]dnsRR{&m.Answer, &m.Authority, &m.Additional}
+	for i, section := range sections {
+		for j := 0; j < counts[i+1]; j++ {
+			rr, n, err := unpackRR(b, off)
+			if err != nil {
+				return nil, err
+			}
+			// a TSIG record has to be the last one of the message
+			if rr.Type == typeTSIG && i == 2 && j == counts[3]-1 {
+				m.tsigAt = off
+			}
+			*section = append(*section, rr)
+			off = n
+		}
+	}
+	m.raw = b
+	return m, nil
+}
+
+// tsigKey signs messages with TSIG.
+type tsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+var tsigAlgorithms = map[string]struct {
+	name string
+	hash func() hash.Hash
+}{
+	"hmac-md5":    {"hmac-md5.sig-alg.reg.int.", md5.New},
+	"hmac-sha1":   {"hmac-sha1.", sha1.New},
+	"hmac-sha256": {"hmac-sha256.", sha256.New},
+}
+
+// parseTSIGKey reads a key of the form "<algorithm>:<name>:<base64 secret>",
+// the format used by nsupdate -y.
+func parseTSIGKey(spec string) (*tsigKey, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("TSIG key has to be of the form <algorithm>:<name>:<secret>")
+	}
+	if _, ok := tsigAlgorithms[strings.ToLower(parts[0])]; !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", parts[0])
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret: %v", err)
+	}
+	return &tsigKey{
+		Name:      strings.ToLower(fqdn(parts[1])),
+		Algorithm: strings.ToLower(parts[0]),
+		Secret:    secret,
+	}, nil
+}
+
+// tsigRecord is the data of a TSIG record.
+type tsigRecord struct {
+	Algorithm string
+	Time      uint64
+	Fudge     uint16
+	MAC       []byte
+	OrigID    uint16
+	Error     uint16
+	Other     []byte
+}
+
+// timers packs the time the message was signed at and the fudge.
+func (t *tsigRecord) timers() []byte {
+	return []byte{
+		byte(t.Time >> 40), byte(t.Time >> 32), byte(t.Time >> 24), byte(t.Time >> 16), byte(t.Time >> 8), byte(t.Time),
+		byte(t.Fudge >> 8), byte(t.Fudge),
+	}
+}
+
+func (t *tsigRecord) pack() []byte {
+	b, _ := packName(nil, t.Algorithm)
+	b = append(b, t.timers()...)
+	b = append(b, byte(len(t.MAC)>>8), byte(len(t.MAC)))
+	b = append(b, t.MAC...)
+	b = append(b, byte(t.OrigID>>8), byte(t.OrigID), byte(t.Error>>8), byte(t.Error))
+	b = append(b, byte(len(t.Other)>>8), byte(len(t.Other)))
+	return append(b, t.Other...)
+}
+
+func unpackTSIG(data []byte) (*tsigRecord, error) {
+	invalid := errors.New("invalid TSIG record")
+	alg, off, err := unpackName(data, 0)
+	if err != nil || off+10 > len(data) {
+		return nil, invalid
+	}
+	t := &tsigRecord{Algorithm: alg}
+	for _, b := range data[off : off+6] {
+		t.Time = t.Time<<8 | uint64(b)
+	}
+	t.Fudge = binary.BigEndian.Uint16(data[off+6:])
+	size := int(binary.BigEndian.Uint16(data[off+8:]))
+	off += 10
+	if off+size+6 > len(data) {
+		return nil, invalid
+	}
+	t.MAC = data[off : off+size]
+	off += size
+	t.OrigID = binary.BigEndian.Uint16(data[off:])
+	t.Error = binary.BigEndian.Uint16(data[off+2:])
+	size = int(binary.BigEndian.Uint16(data[off+4:]))
+	off += 6
+	if off+size != len(data) {
+		return nil, invalid
+	}
+	t.Other = data[off:]
+	return t, nil
+}
+
+// digest computes the MAC of msg signed with t, RFC 8945 section 4.3. The
+// MAC of a response covers the MAC of the request, or of the previous
+// response of a zone transfer, given as prior. The responses following
+// the first one of a zone transfer only cover the timers of t.
+func (k *tsigKey) digest(prior []byte, msg []byte, t *tsigRecord, timersOnly bool) []byte {
+	mac := hmac.New(tsigAlgorithms[k.Algorithm].hash, k.Secret)
+	if prior != nil {
+		mac.Write([]byte{byte(len(prior) >> 8), byte(len(prior))})
+		mac.Write(prior)
+	}
+	mac.Write(msg)
+	if timersOnly {
+		mac.Write(t.timers())
+		return mac.Sum(nil)
+	}
+
+	vars, _ := packName(nil, strings.ToLower(k.Name))
+	vars = append(vars, byte(classANY>>8), byte(classANY), 0, 0, 0, 0)
+	vars, _ = packName(vars, strings.ToLower(t.Algorithm))
+	vars = append(vars, t.timers()...)
+	vars = append(vars, byte(t.Error>>8), byte(t.Error), byte(len(t.Other)>>8), byte(len(t.Other)))
+	vars = append(vars, t.Other...)
+	mac.Write(vars)
+	return mac.Sum(nil)
+}
+
+// tsigFudge is the difference in seconds allowed between the time a
+// message was signed at and the time it is verified at.
+const tsigFudge = 300
+
+// sign packs m and appends a TSIG record to it. It returns the message and
+// its MAC, which the MAC of the response covers.
+func (k *tsigKey) sign(m *dnsMsg, now time.Time) ([]byte, []byte, error) {
+	b, err := m.pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t := &tsigRecord{
+		Algorithm: tsigAlgorithms[k.Algorithm].name,
+		Time:      uint64(now.Unix()),
+		Fudge:     tsigFudge,
+		OrigID:    m.ID,
+	}
+	t.MAC = k.digest(nil, b, t, false)
+
+	rr := dnsRR{Name: k.Name, Type: typeTSIG, Class: classANY, Data: t.pack()}
+	if b, err = rr.pack(b); err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)+1))
+	return b, t.MAC, nil
+}
+
+// packMsg packs m and signs it with key, if it is not nil. It returns the
+// MAC of the message if it was signed.
+func packMsg(m *dnsMsg, key *tsigKey) ([]byte, []byte, error) {
+	if key != nil {
+		return key.sign(m, time.Now())
+	}
+	b, err := m.pack()
+	return b, nil, err
+}
+
+// maxUnsigned is the number of consecutive messages of a zone transfer
+// which may be left unsigned, RFC 8945 section 5.3.1.
+const maxUnsigned = 99
+
+// tsigVerifier verifies the TSIG records of the responses to a request
+// signed with key, of which mac is the MAC. Only the first and the last
+// response of a zone transfer have to be signed, and every 100th in
+// between. The MAC of a signed response covers the unsigned ones before it.
+type tsigVerifier struct {
+	key      *tsigKey
+	mac      []byte
+	verified bool
+	unsigned []byte
+	count    int
+}
+
+// verify checks the TSIG record of a response, if the request was signed.
+func (v *tsigVerifier) verify(m *dnsMsg, now time.Time) error {
+	if v.key == nil {
+		return nil
+	}
+	if m.tsigAt == 0 {
+		switch {
+		case !v.verified && m.Rcode() != rcodeSuccess:
+			// servers don't sign errors about the signature of requests
+			return rcodeError(m.Rcode())
+		case !v.verified:
+			return errors.New("DNS response is not signed")
+		case v.count == maxUnsigned:
+			return fmt.Errorf("more than %d consecutive DNS responses are not signed", maxUnsigned)
+		}
+		v.unsigned = append(v.unsigned, m.raw...)
+		v.count++
+		return nil
+	}
+
+	rr := m.Additional[len(m.Additional)-1]
+	t, err := unpackTSIG(rr.Data)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(rr.Name, v.key.Name) || !strings.EqualFold(t.Algorithm, tsigAlgorithms[v.key.Algorithm].name) {
+		return fmt.Errorf("DNS response is signed with key %s (%s) instead of %s", rr.Name, t.Algorithm, v.key.Name)
+	}
+	if t.Error != rcodeSuccess {
+		return rcodeError(int(t.Error))
+	}
+
+	// the MAC covers the message without the TSIG record, as sent
+	msg := append([]byte{}, m.raw[:m.tsigAt]...)
+	binary.BigEndian.PutUint16(msg[0:], t.OrigID)
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(m.Additional)-1))
+	sum := v.key.digest(v.mac, append(v.unsigned, msg...), t, v.verified)
+	if !hmac.Equal(sum, t.MAC) {
+		return errors.New("TSIG signature of DNS response is invalid")
+	}
+	signed := int64(t.Time)
+	if d := now.Unix() - signed; d > int64(t.Fudge) || -d > int64(t.Fudge) {
+		return fmt.Errorf("TSIG time of DNS response is off by %ds", d)
+	}
+
+	v.mac = t.MAC
+	v.verified = true
+	v.unsigned = nil
+	v.count = 0
+	return nil
+}
+
+// done checks that the last response was signed.
+func (v *tsigVerifier) done() error {
+	if v.key != nil && v.count > 0 {
+		return errors.New("last DNS response is not signed")
+	}
+	return nil
+}
+
+// newMsgID returns an unpredictable message ID, so that responses can't be
+// forged without seeing the query.
+func newMsgID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// answers reports whether m is the response to query, with the same ID
+// and question. Servers may leave out the question of queries they could
+// not parse.
+func (m *dnsMsg) answers(query *dnsMsg) bool {
+	if m.ID != query.ID || m.Flags&flagQR == 0 {
+		return false
+	}
+	if len(m.Question) == 0 && m.Rcode() == rcodeFormatError {
+		return true
+	}
+	if len(m.Question) != len(query.Question) {
+		return false
+	}
+	for i, q := range m.Question {
+		want := query.Question[i]
+		if q.Type != want.Type || q.Class != want.Class || !strings.EqualFold(q.Name, want.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsConn sends messages to a DNS server and reads the responses.
+type dnsConn struct {
+	conn net.Conn
+	tcp  bool
+}
+
+func dialDNS(server string, tcp bool, timeout time.Duration) (*dnsConn, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return &dnsConn{conn: conn, tcp: tcp}, nil
+}
+
+func (c *dnsConn) write(b []byte) error {
+	if c.tcp {
+		b = append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *dnsConn) read() (*dnsMsg, error) {
+	var b []byte
+	if c.tcp {
+		var l [2]byte
+		if _, err := io.ReadFull(c.conn, l[:]); err != nil {
+			return nil, err
+		}
+		b = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c.conn, b); err != nil {
+			return nil, err
+		}
+	} else {
+		b = make([]byte, 65535)
+		n, err := c.conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[:n]
+	}
+	return unpackMsg(b)
+}
+
+func (c *dnsConn) Close() error {
+	return c.conn.Close()
+}
+
+// exchange sends m, packed as b, to server and returns the response.
+// Responses to other queries are ignored. Over UDP, truncated responses are
+// retried over TCP.
+func exchange(server string, m *dnsMsg, b []byte, tcp bool, timeout time.Duration) (*dnsMsg, error) {
+	c, err := dialDNS(server, tcp, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.write(b); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if !resp.answers(m) {
+			// a late response to an earlier query or a forged one, keep
+			// waiting
+			continue
+		}
+		if !tcp && resp.Flags&flagTC != 0 {
+			return exchange(server, m, b, true, timeout)
+		}
+		return resp, nil
+	}
+}
+
+// withPort adds the DNS port to server if it has none.
+func withPort(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
+
+// send exchanges m with server, signed with key if it is not nil, in
+// which case the signature of the response is verified.
+func send(server string, key *tsigKey, m *dnsMsg, timeout time.Duration) (*dnsMsg, error) {
+	b, mac, err := packMsg(m, key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchange(server, m, b, false, timeout)
+	if err != nil {
+		return nil, err
+	}
+	v := &tsigVerifier{key: key, mac: mac}
+	if err := v.verify(resp, time.Now()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// findZone returns the name of the zone name belongs to, as known to
+// server.
+func findZone(server string, key *tsigKey, name string, timeout time.Duration) (string, error) {
+	m := &dnsMsg{
+		ID:       newMsgID(),
+		Question: []dnsQuestion{{Name: fqdn(name), Type: typeSOA, Class: classINET}},
+	}
+	resp, err := send(server, key, m, timeout)
+	if err != nil {
+		return "", err
+	}
+	if resp.Rcode() != rcodeSuccess && len(resp.Authority) == 0 {
+		return "", rcodeError(resp.Rcode())
+	}
+	for _, section := range [][]dnsRR{resp.Answer, resp.Authority} {
+		for _, rr := range section {
+			if rr.Type == typeSOA && inZone(name, rr.Name) {
+				return rr.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no zone found for %s", name)
+}
+
+// inZone reports whether name is zone or below it.
+func inZone(name string, zone string) bool {
+	name = strings.ToLower(fqdn(name))
+	zone = strings.ToLower(fqdn(zone))
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// The MACs below were computed independently of this implementation, with
+// the secret "secretsecretsecretsecret" and the layout of RFC 8945 section
+// 4.3.3.
+const testSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+func testKey(t *testing.T, alg string) *tsigKey {
+	t.Helper()
+	k, err := parseTSIGKey(alg + ":test.key:" + testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func testQuestion() []dnsQuestion {
+	return []dnsQuestion{{Name: "example.com.", Type: typeSOA, Class: classINET}}
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// received packs m like a server would send it, signed with mac if it is
+// not nil, and unpacks it again.
+func received(t *testing.T, m *dnsMsg, mac []byte, at int64, tsigErr uint16) *dnsMsg {
+	t.Helper()
+	b, err := m.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac != nil || tsigErr != 0 {
+		sig := &tsigRecord{
+			Algorithm: "hmac-sha256.",
+			Time:      uint64(at),
+			Fudge:     tsigFudge,
+			MAC:       mac,
+			OrigID:    m.ID,
+			Error:     tsigErr,
+		}
+		rr := dnsRR{Name: "test.key.", Type: typeTSIG, Class: classANY, Data: sig.pack()}
+		if b, err = rr.pack(b); err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)+1))
+	}
+	out, err := unpackMsg(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestTSIGSign(t *testing.T) {
+	tests := []struct {
+		alg string
+		mac string
+	}{
+		{"hmac-md5", "1c8b2d5fb80d1e32414d25f58152f597"},
+		{"hmac-sha1", "21ea57c4f975d25e3ec07967ebdae45188e2258f"},
+		{"hmac-sha256", "ce6c1905b82ea5fc1155eeb84d5a597226ac52118a5a3a8a08e9ca71b37cef75"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			m := &dnsMsg{ID: 0x1234, Flags: opcodeUpdate << 11, Question: testQuestion()}
+			b, mac, err := testKey(t, tt.alg).sign(m, time.Unix(1700000000, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(mac); got != tt.mac {
+				t.Errorf("MAC = %s, want %s", got, tt.mac)
+			}
+
+			signed, err := unpackMsg(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signed.tsigAt == 0 || len(signed.Additional) != 1 {
+				t.Fatalf("message carries no TSIG record: %+v", signed)
+			}
+			sig, err := unpackTSIG(signed.Additional[0].Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sig.Time != 1700000000 || sig.Fudge != tsigFudge || sig.OrigID != 0x1234 || hex.EncodeToString(sig.MAC) != tt.mac {
+				t.Errorf("TSIG record = %+v", sig)
+			}
+		})
+	}
+}
+
+func TestTSIGVerify(t *testing.T) {
+	requestMAC := "ce6c1905b82ea5fc1155eeb84d5a597226ac52118a5a3a8a08e9ca71b37cef75"
+	responseMAC := "a592159f457e6f038ae4a524fbcd71e3c12e8f9fd351b08f392aa2a1321affd7"
+	response := func() *dnsMsg {
+		return &dnsMsg{ID: 0x1234, Flags: flagQR | opcodeUpdate<<11, Question: testQuestion()}
+	}
+
+	tests := []struct {
+		name  string
+		resp  func(t *testing.T) *dnsMsg
+		now   int64
+		valid bool
+	}{
+		{
+			name:  "valid",
+			resp:  func(t *testing.T) *dnsMsg { return received(t, response(), fromHex(t, responseMAC), 1700000005, 0) },
+			now:   1700000010,
+			valid: true,
+		},
+		{
+			name: "modified",
+			resp: func(t *testing.T) *dnsMsg {
+				m := response()
+				m.Flags |= rcodeNameError
+				return received(t, m, fromHex(t, responseMAC), 1700000005, 0)
+			},
+			now: 1700000010,
+		},
+		{
+			name: "too late",
+			resp: func(t *testing.T) *dnsMsg { return received(t, response(), fromHex(t, responseMAC), 1700000005, 0) },
+			now:  1700000005 + tsigFudge + 1,
+		},
+		{
+			name: "unsigned",
+			resp: func(t *testing.T) *dnsMsg { return received(t, response(), nil, 0, 0) },
+			now:  1700000010,
+		},
+		{
+			name: "signature rejected",
+			resp: func(t *testing.T) *dnsMsg { return received(t, response(), nil, 1700000005, 16) },
+			now:  1700000010,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &tsigVerifier{key: testKey(t, "hmac-sha256"), mac: fromHex(t, requestMAC)}
+			err := v.verify(tt.resp(t), time.Unix(tt.now, 0))
+			if tt.valid && err != nil {
+				t.Errorf("verify: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("verify succeeded")
+			}
+		})
+	}
+}
+
+func TestTSIGVerifyTransfer(t *testing.T) {
+	key := testKey(t, "hmac-sha256")
+	requestMAC := fromHex(t, "ce6c1905b82ea5fc1155eeb84d5a597226ac52118a5a3a8a08e9ca71b37cef75")
+	firstMAC := fromHex(t, "c34ec60bb9ca6defdde0d276700c4f1fd5d47f451bec03387820ac771066d248")
+	lastMAC := fromHex(t, "ad0ad96a126bdfc7a5e0fd1b36acd8d23bff967b02c22629bc6b641b2fe9d93b")
+
+	txt := dnsRR{Name: "a.example.com.", Type: typeTXT, Class: classINET, TTL: 60, Data: []byte("\x02hi")}
+	first := received(t, &dnsMsg{ID: 0x1234, Flags: flagQR, Question: testQuestion()}, firstMAC, 1700000005, 0)
+	middle := received(t, &dnsMsg{ID: 0x1234, Flags: flagQR, Question: testQuestion(), Answer: []dnsRR{txt}}, nil, 0, 0)
+	last := received(t, &dnsMsg{ID: 0x1234, Flags: flagQR, Question: testQuestion()}, lastMAC, 1700000006, 0)
+	now := time.Unix(1700000010, 0)
+
+	v := &tsigVerifier{key: key, mac: requestMAC}
+	for i, m := range []*dnsMsg{first, middle} {
+		if err := v.verify(m, now); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	if err := v.done(); err == nil {
+		t.Error("transfer ending with an unsigned message was accepted")
+	}
+	if err := v.verify(last, now); err != nil {
+		t.Fatalf("message 3: %v", err)
+	}
+	if err := v.done(); err != nil {
+		t.Errorf("done: %v", err)
+	}
+
+	// the last MAC doesn't cover a transfer without the middle message
+	v = &tsigVerifier{key: key, mac: requestMAC}
+	if err := v.verify(first, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(last, now); err == nil {
+		t.Error("transfer missing a message was accepted")
+	}
+}
+
+func TestMsgAnswers(t *testing.T) {
+	query := &dnsMsg{ID: 0x1234, Question: testQuestion()}
+	tests := []struct {
+		name string
+		resp dnsMsg
+		want bool
+	}{
+		{"response", dnsMsg{ID: 0x1234, Flags: flagQR, Question: testQuestion()}, true},
+		{"case of the name", dnsMsg{ID: 0x1234, Flags: flagQR, Question: []dnsQuestion{{Name: "Example.COM.", Type: typeSOA, Class: classINET}}}, true},
+		{"format error", dnsMsg{ID: 0x1234, Flags: flagQR | rcodeFormatError}, true},
+		{"other ID", dnsMsg{ID: 0x4321, Flags: flagQR, Question: testQuestion()}, false},
+		{"query", dnsMsg{ID: 0x1234, Question: testQuestion()}, false},
+		{"no question", dnsMsg{ID: 0x1234, Flags: flagQR}, false},
+		{"other name", dnsMsg{ID: 0x1234, Flags: flagQR, Question: []dnsQuestion{{Name: "example.net.", Type: typeSOA, Class: classINET}}}, false},
+		{"other type", dnsMsg{ID: 0x1234, Flags: flagQR, Question: []dnsQuestion{{Name: "example.com.", Type: typeA, Class: classINET}}}, false},
+		{"other class", dnsMsg{ID: 0x1234, Flags: flagQR, Question: []dnsQuestion{{Name: "example.com.", Type: typeSOA, Class: classANY}}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.resp.answers(query); got != tt.want {
+			t.Errorf("%s: answers = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExchangeIgnoresOtherResponses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	query := &dnsMsg{ID: newMsgID(), Question: testQuestion()}
+	go func() {
+		b := make([]byte, 512)
+		_, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		// a forged response with the right ID but another question comes
+		// first
+		forged := &dnsMsg{ID: query.ID, Flags: flagQR, Question: []dnsQuestion{{Name: "example.net.", Type: typeSOA, Class: classINET}}}
+		answer := &dnsMsg{ID: query.ID, Flags: flagQR, Question: testQuestion(), Answer: []dnsRR{soaRR("example.com.", 7)}}
+		for _, m := range []*dnsMsg{forged, answer} {
+			b, err := m.pack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.WriteTo(b, addr)
+		}
+	}()
+
+	b, err := query.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := exchange(conn.LocalAddr().String(), query, b, false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Serial() != 7 {
+		t.Errorf("got the response %+v, want the one to the query", resp)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// DNSUpdater creates and removes the forward and reverse records of hosts
+// on an authoritative DNS server using dynamic updates.
+type DNSUpdater struct {
+	Server  string
+	Key     *tsigKey
+	TTL     uint32
+	Timeout time.Duration
+}
+
+// NewDNSUpdater creates a DNSUpdater sending updates to server, signed with
+// key if it is not empty. See parseTSIGKey for the format of key.
+func NewDNSUpdater(server string, key string, ttl int) (*DNSUpdater, error) {
+	u := &DNSUpdater{
+		Server:  withPort(server),
+		TTL:     uint32(ttl),
+		Timeout: 5 * time.Second,
+	}
+	if key != "" {
+		k, err := parseTSIGKey(key)
+		if err != nil {
+			return nil, err
+		}
+		u.Key = k
+	}
+	return u, nil
+}
+
+// update sends the records of updates to the zone name belongs to.
+func (u *DNSUpdater) update(name string, updates []dnsRR) error {
+	zone, err := findZone(u.Server, u.Key, name, u.Timeout)
+	if err != nil {
+		return err
+	}
+
+	m := &dnsMsg{
+		ID:        newMsgID(),
+		Flags:     opcodeUpdate << 11,
+		Question:  []dnsQuestion{{Name: zone, Type: typeSOA, Class: classINET}},
+		Authority: updates,
+	}
+	resp, err := send(u.Server, u.Key, m, u.Timeout)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode() != rcodeSuccess {
+		return rcodeError(resp.Rcode())
+	}
+	return nil
+}
+
+// Register adds an A or AAAA record for hostname and replaces the PTR
+// record of ip. Forward and reverse records are in different zones and
+// can't be updated together, so the A or AAAA record is removed again if
+// the PTR record could not be replaced.
+func (u *DNSUpdater) Register(hostname string, ip net.IP) error {
+	hostname = fqdn(hostname)
+	rev := reverseName(ip)
+	ptr, err := ptrRR(rev, hostname, u.TTL)
+	if err != nil {
+		return err
+	}
+
+	if err := u.update(hostname, []dnsRR{addressRR(hostname, ip, u.TTL)}); err != nil {
+		return fmt.Errorf("could not add %s: %v", hostname, err)
+	}
+	deletePTRs := dnsRR{Name: rev, Type: typePTR, Class: classANY}
+	if err := u.update(rev, []dnsRR{deletePTRs, ptr}); err != nil {
+		if rerr := u.removeAddress(hostname, ip); rerr != nil {
+			return fmt.Errorf("could not add %s: %v, and %v", rev, err, rerr)
+		}
+		return fmt.Errorf("could not add %s: %v", rev, err)
+	}
+	return nil
+}
+
+// removeAddress removes the A or AAAA record of hostname pointing to ip.
+func (u *DNSUpdater) removeAddress(hostname string, ip net.IP) error {
+	addr := addressRR(hostname, ip, 0)
+	addr.Class = classNONE
+	if err := u.update(hostname, []dnsRR{addr}); err != nil {
+		return fmt.Errorf("could not remove %s: %v", hostname, err)
+	}
+	return nil
+}
+
+// Unregister removes the A or AAAA record of hostname pointing to ip and
+// the PTR records of ip.
+func (u *DNSUpdater) Unregister(hostname string, ip net.IP) error {
+	hostname = fqdn(hostname)
+	if err := u.removeAddress(hostname, ip); err != nil {
+		return err
+	}
+
+	rev := reverseName(ip)
+	deletePTRs := dnsRR{Name: rev, Type: typePTR, Class: classANY}
+	if err := u.update(rev, []dnsRR{deletePTRs}); err != nil {
+		return fmt.Errorf("could not remove %s: %v", rev, err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events. Reservation events are named after the LockEvent they
+// come from, IP events are found by comparing scans.
+const (
+	eventBecamePingable   = "ip.became_pingable"
+	eventBecameUnpingable = "ip.became_unpingable"
+	eventPTRChanged       = "ip.ptr_changed"
+)
+
+// event describes a change of a reservation or of an IP. Old and New hold
+// the PTR before and after ip.ptr_changed.
+type event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Network string    `json:"network"`
+	IP      string    `json:"ip"`
+	Lock    *Lock     `json:"lock,omitempty"`
+	Old     string    `json:"old,omitempty"`
+	New     string    `json:"new,omitempty"`
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// eventHook is an URL events are posted to, only those matching Types if
+// there are any.
+type eventHook struct {
+	URL   string
+	Types []string
+	queue chan event
+}
+
+// wants reports whether the hook subscribed to events of typ. Types ending
+// with "*" match all types starting with what comes before.
+func (h *eventHook) wants(typ string) bool {
+	if len(h.Types) == 0 {
+		return true
+	}
+	for _, t := range h.Types {
+		if t == typ || (strings.HasSuffix(t, "*") && strings.HasPrefix(typ, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *eventHook) String() string {
+	return redactURL(h.URL)
+}
+
+// parseEventHooks reads hooks separated by commas or whitespace, each in
+// the form "<type>|<type>=<url>" or just "<url>" for all events.
+func parseEventHooks(spec string) ([]*eventHook, error) {
+	var out []*eventHook
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		h := &eventHook{URL: entry}
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 && !strings.Contains(parts[0], "://") {
+			h.URL = parts[1]
+			h.Types = strings.Split(parts[0], "|")
+		}
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid event hook %q, expected [<type>|<type>=]<http(s) url>", entry)
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// maxBackoff is the longest time between two attempts to deliver an event.
+const maxBackoff = 5 * time.Minute
+
+// Events posts events to the hooks subscribed to them. Every hook gets its
+// events in order. Deliveries which fail are retried Retries times, waiting
+// twice as long as before each time, starting with Backoff. Events which
+// could not be delivered are appended to the file DeadLetter as JSON.
+// Bodies are signed with an HMAC-SHA256 of Secret, sent as
+// "X-Netmgmt-Signature: sha256=<hex>".
+type Events struct {
+	Secret     string
+	Retries    int
+	Backoff    time.Duration
+	DeadLetter string
+	hooks      []*eventHook
+	deadMu     sync.Mutex
+}
+
+var events = Events{Retries: 5, Backoff: time.Second}
+
+// eventQueueSize is the number of events waiting to be delivered to a hook,
+// further ones go to the dead letters right away.
+const eventQueueSize = 1000
+
+// Start delivers events to hooks from now on.
+func (e *Events) Start(hooks []*eventHook) {
+	e.hooks = hooks
+	for _, h := range hooks {
+		h.queue = make(chan event, eventQueueSize)
+		go func(h *eventHook) {
+			for ev := range h.queue {
+				e.deliver(h, ev)
+			}
+		}(h)
+	}
+}
+
+// Emit queues ev for the hooks subscribed to it, without waiting for them.
+func (e *Events) Emit(ev event) {
+	if ev.ID == "" {
+		ev.ID = newEventID()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, h := range e.hooks {
+		if !h.wants(ev.Type) {
+			continue
+		}
+		select {
+		case h.queue <- ev:
+		default:
+			e.deadLetter(h, ev, 0, fmt.Errorf("more than %d events waiting", eventQueueSize))
+		}
+	}
+}
+
+// sign returns the signature of body.
+func (e *Events) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(e.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (e *Events) post(h *eventHook, ev event, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Netmgmt-Event", ev.Type)
+	req.Header.Set("X-Netmgmt-Delivery", ev.ID)
+	if e.Secret != "" {
+		req.Header.Set("X-Netmgmt-Signature", e.sign(body))
+	}
+
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("hook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// deliver posts ev to h, retrying until it succeeds or the retries are
+// used up.
+func (e *Events) deliver(h *eventHook, ev event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		e.deadLetter(h, ev, 0, err)
+		return
+	}
+
+	backoff := e.Backoff
+	for attempt := 0; ; attempt++ {
+		if err = e.post(h, ev, body); err == nil {
+			return
+		}
+		if attempt >= e.Retries {
+			break
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	log.Printf("could not deliver event %s %s to %v: %v", ev.Type, ev.ID, h, err)
+	e.deadLetter(h, ev, e.Retries+1, err)
+}
+
+// deadLetter records an event which could not be delivered.
+func (e *Events) deadLetter(h *eventHook, ev event, attempts int, reason error) {
+	if e.DeadLetter == "" {
+		return
+	}
+	b, err := json.Marshal(struct {
+		Time     time.Time `json:"time"`
+		Hook     string    `json:"hook"`
+		Attempts int       `json:"attempts"`
+		Error    string    `json:"error"`
+		Event    event     `json:"event"`
+	}{time.Now(), h.String(), attempts, reason.Error(), ev})
+	if err != nil {
+		return
+	}
+
+	e.deadMu.Lock()
+	defer e.deadMu.Unlock()
+
+	f, err := os.OpenFile(e.DeadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("could not write dead letter of event %s: %v", ev.ID, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("could not write dead letter of event %s: %v", ev.ID, err)
+	}
+}
+
+// RecordLock emits the changes of reservations. It is meant to be
+// subscribed to the Locker.
+func (e *Events) RecordLock(le LockEvent) {
+	lock := le.Lock
+	e.Emit(event{
+		Type:    "reservation." + le.Type,
+		Time:    le.Time,
+		Network: networkOf(net.ParseIP(le.IP)),
+		IP:      le.IP,
+		Lock:    &lock,
+	})
+}
+
+// RecordScan emits the changes of the IPs of a network between two scans.
+// The names of IPs which could not be resolved by either scan are unknown
+// and not compared.
+func (e *Events) RecordScan(old *scan, sc *scan) {
+	if len(e.hooks) == 0 {
+		return
+	}
+	now := time.Now()
+	for ip, r := range sc.results {
+		o, ok := old.results[ip]
+		if !ok {
+			continue
+		}
+		ev := event{Time: now, Network: sc.Network, IP: ip}
+		switch {
+		case r.Pingable && !o.Pingable:
+			ev.Type = eventBecamePingable
+			e.Emit(ev)
+		case !r.Pingable && o.Pingable:
+			ev.Type = eventBecameUnpingable
+			e.Emit(ev)
+		}
+		if r.Name != o.Name && !old.unresolved[ip] && !sc.unresolved[ip] {
+			ev.Type = eventPTRChanged
+			ev.Old = o.Name
+			ev.New = r.Name
+			e.Emit(ev)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseEventHooks(t *testing.T) {
+	tests := []struct {
+		spec    string
+		urls    []string
+		types   [][]string
+		wantErr bool
+	}{
+		{spec: ""},
+		{
+			spec:  "https://hooks.example.com/all",
+			urls:  []string{"https://hooks.example.com/all"},
+			types: [][]string{nil},
+		},
+		{
+			spec:  "reservation.*|ip.ptr_changed=http://a.example.com/x?token=a=b, https://b.example.com\nip.*=https://c.example.com",
+			urls:  []string{"http://a.example.com/x?token=a=b", "https://b.example.com", "https://c.example.com"},
+			types: [][]string{{"reservation.*", "ip.ptr_changed"}, nil, {"ip.*"}},
+		},
+		{spec: "ftp://files.example.com", wantErr: true},
+		{spec: "reservation.created=hooks.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		hooks, err := parseEventHooks(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		var urls []string
+		var types [][]string
+		for _, h := range hooks {
+			urls = append(urls, h.URL)
+			types = append(types, h.Types)
+		}
+		if !reflect.DeepEqual(urls, tt.urls) || !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("%q: got %v %v, want %v %v", tt.spec, urls, types, tt.urls, tt.types)
+		}
+	}
+}
+
+func TestEventHookWants(t *testing.T) {
+	tests := []struct {
+		types []string
+		typ   string
+		want  bool
+	}{
+		{nil, "reservation.created", true},
+		{[]string{"reservation.created"}, "reservation.created", true},
+		{[]string{"reservation.created"}, "reservation.released", false},
+		{[]string{"reservation.*"}, "reservation.released", true},
+		{[]string{"reservation.*"}, "ip.ptr_changed", false},
+		{[]string{"ip.ptr_changed", "*"}, "reservation.expired", true},
+		{[]string{"ip.became_*"}, "ip.became_unpingable", true},
+	}
+	for _, tt := range tests {
+		h := &eventHook{Types: tt.types}
+		if got := h.wants(tt.typ); got != tt.want {
+			t.Errorf("%v wants %s = %v, want %v", tt.types, tt.typ, got, tt.want)
+		}
+	}
+}
+
+// queuedEvents returns the events waiting in the queue of h.
+func queuedEvents(h *eventHook) []event {
+	var out []event
+	for {
+		select {
+		case ev := <-h.queue:
+			out = append(out, ev)
+		default:
+			sort.Slice(out, func(i, j int) bool {
+				if out[i].IP != out[j].IP {
+					return out[i].IP < out[j].IP
+				}
+				return out[i].Type < out[j].Type
+			})
+			return out
+		}
+	}
+}
+
+func TestEventsRecordScan(t *testing.T) {
+	h := &eventHook{queue: make(chan event, 10)}
+	e := &Events{hooks: []*eventHook{h}}
+
+	old := &scan{
+		Network: "test",
+		results: map[string]*ResultSet{
+			"192.0.2.1": {Pingable: false},
+			"192.0.2.2": {Pingable: true, Name: "a.example.com."},
+			"192.0.2.3": {Name: "old.example.com."},
+			"192.0.2.4": {Name: "b.example.com."},
+			"192.0.2.5": {},
+			"192.0.2.6": {Pingable: true, Name: "c.example.com."},
+		},
+		// the name of .5 was unknown to the last scan
+		unresolved: map[string]bool{"192.0.2.5": true},
+	}
+	sc := &scan{
+		Network: "test",
+		results: map[string]*ResultSet{
+			"192.0.2.1": {Pingable: true},
+			"192.0.2.2": {Pingable: false, Name: "a.example.com."},
+			"192.0.2.3": {Name: "new.example.com."},
+			"192.0.2.4": {},
+			"192.0.2.5": {Name: "d.example.com."},
+			"192.0.2.6": {Pingable: true},
+			// not part of the last scan
+			"192.0.2.7": {Pingable: true, Name: "e.example.com."},
+		},
+		// the lookup of .6 failed, it still has its name
+		unresolved: map[string]bool{"192.0.2.6": true},
+	}
+	e.RecordScan(old, sc)
+
+	var got []string
+	for _, ev := range queuedEvents(h) {
+		if ev.Network != "test" || ev.Time.IsZero() {
+			t.Errorf("event %+v lacks the network or time", ev)
+		}
+		got = append(got, ev.IP+" "+ev.Type+" "+ev.Old+" "+ev.New)
+	}
+	want := []string{
+		"192.0.2.1 ip.became_pingable  ",
+		"192.0.2.2 ip.became_unpingable  ",
+		"192.0.2.3 ip.ptr_changed old.example.com. new.example.com.",
+		"192.0.2.4 ip.ptr_changed b.example.com. ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events =\n%q\nwant\n%q", got, want)
+	}
+}
+
+// hookServer records the events posted to it and fails the first failures
+// deliveries.
+type hookServer struct {
+	sync.Mutex
+	*httptest.Server
+	failures   int
+	attempts   int
+	signatures []string
+	bodies     [][]byte
+}
+
+func newHookServer(t *testing.T, failures int) *hookServer {
+	t.Helper()
+	s := &hookServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		s.Lock()
+		defer s.Unlock()
+		s.attempts++
+		if s.attempts <= s.failures {
+			http.Error(res, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if req.Header.Get("Content-Type") != "application/json" || req.Header.Get("X-Netmgmt-Event") == "" || req.Header.Get("X-Netmgmt-Delivery") == "" {
+			t.Errorf("headers = %v", req.Header)
+		}
+		s.signatures = append(s.signatures, req.Header.Get("X-Netmgmt-Signature"))
+		s.bodies = append(s.bodies, body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestEventsDeliver(t *testing.T) {
+	s := newHookServer(t, 2)
+	e := &Events{Secret: "secret", Retries: 2, Backoff: time.Millisecond}
+	h := &eventHook{URL: s.URL}
+	ev := event{ID: "1", Type: "reservation.created", Network: "test", IP: "192.0.2.1"}
+
+	e.deliver(h, ev)
+	if s.attempts != 3 || len(s.bodies) != 1 {
+		t.Fatalf("%d attempts and %d deliveries, want 3 and 1", s.attempts, len(s.bodies))
+	}
+	var got event
+	if err := json.Unmarshal(s.bodies[0], &got); err != nil || got.ID != "1" || got.IP != "192.0.2.1" {
+		t.Errorf("body %s: %v", s.bodies[0], err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(s.bodies[0])
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); s.signatures[0] != want {
+		t.Errorf("signature = %s, want %s", s.signatures[0], want)
+	}
+
+	// without a secret the events are not signed
+	e.Secret = ""
+	e.deliver(h, ev)
+	if len(s.signatures) != 2 || s.signatures[1] != "" {
+		t.Errorf("signatures = %v, want the second one empty", s.signatures)
+	}
+}
+
+func TestEventsDeadLetter(t *testing.T) {
+	s := newHookServer(t, 100)
+	path := filepath.Join(t.TempDir(), "dead.log")
+	e := &Events{Retries: 1, Backoff: time.Millisecond, DeadLetter: path}
+	h := &eventHook{URL: s.URL + "/hook?token=secret"}
+
+	e.deliver(h, event{ID: "1", Type: "reservation.created"})
+	if s.attempts != 2 {
+		t.Errorf("%d attempts, want 2", s.attempts)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type deadLetter struct {
+		Hook     string `json:"hook"`
+		Attempts int    `json:"attempts"`
+		Error    string `json:"error"`
+		Event    event  `json:"event"`
+	}
+	var letters []deadLetter
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var l deadLetter
+		if err := json.Unmarshal(line, &l); err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, l)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+	l := letters[0]
+	if l.Attempts != 2 || l.Error == "" || l.Event.ID != "1" || l.Hook != redactURL(h.URL) {
+		t.Errorf("dead letter = %+v", l)
+	}
+}
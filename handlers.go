@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"math/rand"
+	"errors"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 )
 
+// withUtilization returns a copy of n with the utilization of its latest
+// scan. The networks are shared with the scanner and are never written to.
+func withUtilization(n *network) *network {
+	out := *n
+	if sc := scanner.Get(n.Name); sc != nil {
+		out.Utilization = sc.Utilization
+	}
+	return &out
+}
+
 func GetNodeInfo(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 	vars := mux.Vars(req)
@@ -20,16 +34,20 @@ func GetNodeInfo(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	sets, err := Resolv(node)
+	ctx, cancel := context.WithTimeout(req.Context(), checkTimeout)
+	defer cancel()
+
+	sets, err := Resolv(ctx, node)
 	if err != nil {
 		r.JSON(res, http.StatusNotFound, "Node could not be resolved")
 		return
 	}
 
+	list := visible(req, getNetworks())
 	for _, s := range sets {
-		for _, n := range networks {
-			if n.Contains(s.Addr) {
-				r.JSON(res, http.StatusOK, n)
+		for _, n := range list {
+			if !n.Container && n.Contains(s.Addr) {
+				r.JSON(res, http.StatusOK, withUtilization(n))
 				return
 			}
 		}
@@ -39,7 +57,11 @@ func GetNodeInfo(res http.ResponseWriter, req *http.Request) {
 
 func GetNetworks(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
-	r.JSON(res, http.StatusOK, networks)
+	list := visible(req, getNetworks())
+	for i, n := range list {
+		list[i] = withUtilization(n)
+	}
+	r.JSON(res, http.StatusOK, list)
 }
 
 func GetNetwork(res http.ResponseWriter, req *http.Request) {
@@ -52,15 +74,317 @@ func GetNetwork(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	for _, network := range networks {
+	for _, network := range getNetworks() {
 		if network.Name == network_name {
-			r.JSON(res, http.StatusOK, network)
+			if !authorize(res, req, r, roleViewer, network) {
+				return
+			}
+			r.JSON(res, http.StatusOK, withUtilization(network))
 			return
 		}
 	}
 	r.JSON(res, http.StatusNotFound, "No matching network found")
 }
 
+// decodeNetwork reads the definition of the network name from the body of
+// req and validates it.
+func decodeNetwork(req *http.Request, name string) (*network, error) {
+	var n network
+	if err := json.NewDecoder(req.Body).Decode(&n); err != nil {
+		return nil, errors.New("Could not extract request body")
+	}
+	if n.Name == "" {
+		n.Name = name
+	}
+	if n.Name != name {
+		return nil, errors.New("Name of the network does not match the URL")
+	}
+	n.Utilization = utilization{}
+	if err := checkNetwork(&n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// checkNetwork validates n and checks that it fits in with the other
+// networks.
+func checkNetwork(n *network) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	list := getNetworks()
+	for _, o := range list {
+		if o.Name != n.Name && n.Conflicts(*o) {
+			return errors.New("Network overlaps with network " + o.Name)
+		}
+	}
+	return n.checkParent(list)
+}
+
+// errContainer is returned for requests on containers which only make
+// sense for the networks in them.
+var errContainer = errors.New("Network is a container, use one of the networks in it")
+
+// authorize answers with 403 and returns false unless the user has at
+// least role on n, nil standing for netmgmt itself.
+func authorize(res http.ResponseWriter, req *http.Request, r *render.Render, role string, n *network) bool {
+	if currentIdentity(req).can(role, n) {
+		return true
+	}
+	where := "globally"
+	if n != nil {
+		where = "on network " + n.Name
+	}
+	r.JSON(res, http.StatusForbidden, "Permission denied, this requires the role "+role+" "+where)
+	return false
+}
+
+// visible returns the networks of list the user may view.
+func visible(req *http.Request, list []*network) []*network {
+	id := currentIdentity(req)
+	out := []*network{}
+	for _, n := range list {
+		if id.can(roleViewer, n) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func PostNetwork(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	netdefMu.Lock()
+	defer netdefMu.Unlock()
+
+	if findNetwork(vars["net"]) != nil {
+		r.JSON(res, http.StatusConflict, "Network already exists")
+		return
+	}
+
+	n, err := decodeNetwork(req, vars["net"])
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorize(res, req, r, roleNetworkAdmin, n) {
+		return
+	}
+
+	if err := saveNetwork(config.File, n, false); err != nil {
+		r.JSON(res, http.StatusInternalServerError, "Could not write network definitions: "+err.Error())
+		return
+	}
+	setNetworks(append(append([]*network{}, getNetworks()...), n))
+	r.JSON(res, http.StatusCreated, n)
+}
+
+func PutNetwork(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	netdefMu.Lock()
+	defer netdefMu.Unlock()
+
+	old := findNetwork(vars["net"])
+	if old == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+	if !authorize(res, req, r, roleNetworkAdmin, old) {
+		return
+	}
+
+	n, err := decodeNetwork(req, vars["net"])
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	// networks may not be moved out of the scope of the user
+	if !authorize(res, req, r, roleNetworkAdmin, n) {
+		return
+	}
+
+	if err := saveNetwork(config.File, n, true); err != nil {
+		r.JSON(res, http.StatusInternalServerError, "Could not write network definitions: "+err.Error())
+		return
+	}
+	current := getNetworks()
+	updated := make([]*network, len(current))
+	for i, o := range current {
+		if o.Name == n.Name {
+			updated[i] = n
+		} else {
+			updated[i] = o
+		}
+	}
+	setNetworks(updated)
+	scanner.Forget(n.Name)
+	r.JSON(res, http.StatusOK, n)
+}
+
+func DeleteNetwork(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	netdefMu.Lock()
+	defer netdefMu.Unlock()
+
+	n := findNetwork(vars["net"])
+	if n == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+	if !authorize(res, req, r, roleNetworkAdmin, n) {
+		return
+	}
+
+	for _, o := range getNetworks() {
+		if o.Parent == n.Name {
+			r.JSON(res, http.StatusConflict, "Network still contains network "+o.Name)
+			return
+		}
+	}
+
+	locker.Clean()
+	for ip := range locker.List() {
+		if n.Contains(net.ParseIP(ip)) {
+			r.JSON(res, http.StatusConflict, "Network still has reservations")
+			return
+		}
+	}
+
+	if err := deleteNetwork(config.File, n.Name); err != nil {
+		r.JSON(res, http.StatusInternalServerError, "Could not write network definitions: "+err.Error())
+		return
+	}
+	var updated []*network
+	for _, o := range getNetworks() {
+		if o.Name != n.Name {
+			updated = append(updated, o)
+		}
+	}
+	setNetworks(updated)
+	scanner.Forget(n.Name)
+	r.JSON(res, http.StatusOK, n)
+}
+
+// maxSubnets is the number of free subnets listed if no limit is given.
+const maxSubnets = 100
+
+// subnetQuery reads the container and the prefix length of the subnets
+// asked for.
+func subnetQuery(req *http.Request) (*network, int, int, error) {
+	container := findNetwork(mux.Vars(req)["net"])
+	if container == nil {
+		return nil, 0, http.StatusNotFound, errors.New("No matching network found")
+	}
+	if !container.Container {
+		return nil, 0, http.StatusBadRequest, errors.New("Network is not a container")
+	}
+	prefix, err := strconv.Atoi(req.URL.Query().Get("prefix"))
+	if err != nil {
+		return nil, 0, http.StatusBadRequest, errors.New("Invalid prefix length provided")
+	}
+	return container, prefix, 0, nil
+}
+
+func GetFreeSubnets(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	container, prefix, status, err := subnetQuery(req)
+	if err != nil {
+		r.JSON(res, status, err.Error())
+		return
+	}
+	if !authorize(res, req, r, roleViewer, container) {
+		return
+	}
+
+	limit := maxSubnets
+	if l := req.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			r.JSON(res, http.StatusBadRequest, "Invalid limit provided")
+			return
+		}
+	}
+
+	subnets, err := freeSubnets(container, prefix, getNetworks(), limit)
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	r.JSON(res, http.StatusOK, freeSubnetList{
+		Container: container.Name,
+		CIDR:      container.CIDR,
+		Prefix:    prefix,
+		Subnets:   subnets,
+	})
+}
+
+// PostFreeSubnet creates the network in the body in the first free subnet
+// of the container.
+func PostFreeSubnet(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	netdefMu.Lock()
+	defer netdefMu.Unlock()
+
+	container, prefix, status, err := subnetQuery(req)
+	if err != nil {
+		r.JSON(res, status, err.Error())
+		return
+	}
+	if !authorize(res, req, r, roleNetworkAdmin, container) {
+		return
+	}
+
+	var n network
+	if err := json.NewDecoder(req.Body).Decode(&n); err != nil {
+		r.JSON(res, http.StatusBadRequest, "Could not extract request body")
+		return
+	}
+	if n.Name == "" {
+		r.JSON(res, http.StatusBadRequest, "No network name provided")
+		return
+	}
+	if findNetwork(n.Name) != nil {
+		r.JSON(res, http.StatusConflict, "Network already exists")
+		return
+	}
+
+	subnets, err := freeSubnets(container, prefix, getNetworks(), 1)
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(subnets) == 0 {
+		r.JSON(res, http.StatusConflict, "No free subnet left in the container")
+		return
+	}
+	n.CIDR = subnets[0]
+	n.Parent = container.Name
+	if n.DC == "" {
+		n.DC = container.DC
+	}
+	n.Utilization = utilization{}
+	if !authorize(res, req, r, roleNetworkAdmin, &n) {
+		return
+	}
+	if err := checkNetwork(&n); err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := saveNetwork(config.File, &n, false); err != nil {
+		r.JSON(res, http.StatusInternalServerError, "Could not write network definitions: "+err.Error())
+		return
+	}
+	setNetworks(append(append([]*network{}, getNetworks()...), &n))
+	r.JSON(res, http.StatusCreated, &n)
+}
+
 func GetNetworkIps(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 	vars := mux.Vars(req)
@@ -71,17 +395,33 @@ func GetNetworkIps(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	for _, network := range networks {
+	for _, network := range getNetworks() {
 		if network.Name == network_name {
-			ips, err := network.ExpandDetailed()
+			if network.Container {
+				r.JSON(res, http.StatusBadRequest, errContainer.Error())
+				return
+			}
+			refresh := req.URL.Query().Get("refresh") == "true"
+			role := roleViewer
+			if refresh {
+				role = roleReserver
+			}
+			if !authorize(res, req, r, role, network) {
+				return
+			}
+			var sc *scan
+			var err error
+			if refresh {
+				sc, err = scanner.Scan(network)
+			} else {
+				sc, err = scanner.Latest(network)
+			}
 			if err != nil {
 				r.JSON(res, http.StatusInternalServerError, "Network could not be expanded")
 				return
 			}
 
-			c := NewCheck(ips)
-			c.Run()
-			network.Utilization = c.utilization
+			c := sc.fresh()
 
 			var out []*ResultSet
 
@@ -89,6 +429,10 @@ func GetNetworkIps(res http.ResponseWriter, req *http.Request) {
 				out = append(out, elem)
 			}
 
+			res.Header().Set("X-Scanned-At", sc.Finished.Format(time.RFC3339))
+			if sc.Incomplete {
+				res.Header().Set("X-Incomplete", "true")
+			}
 			r.JSON(res, http.StatusOK, out)
 			return
 
@@ -97,6 +441,63 @@ func GetNetworkIps(res http.ResponseWriter, req *http.Request) {
 	r.JSON(res, http.StatusNotFound, "No matching network found")
 }
 
+func GetScan(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+
+	if !authorize(res, req, r, roleViewer, network) {
+		return
+	}
+
+	sc := scanner.Get(network.Name)
+	if sc == nil {
+		r.JSON(res, http.StatusNotFound, "Network was not scanned yet")
+		return
+	}
+	r.JSON(res, http.StatusOK, sc)
+}
+
+func PostScan(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+	if network.Container {
+		r.JSON(res, http.StatusBadRequest, errContainer.Error())
+		return
+	}
+	if !authorize(res, req, r, roleReserver, network) {
+		return
+	}
+
+	sc, err := scanner.Scan(network)
+	if err != nil {
+		r.JSON(res, http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.JSON(res, http.StatusOK, sc)
+}
+
+type reservationRequest struct {
+	Comment    string `json:"comment"`
+	IP         string `json:"ip"`
+	Strategy   string `json:"strategy"`
+	Offset     int    `json:"offset"`
+	Count      int    `json:"count"`
+	Contiguous bool   `json:"contiguous"`
+	Prefix     int    `json:"prefix"`
+}
+
 func PostReservation(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
 	vars := mux.Vars(req)
@@ -108,55 +509,767 @@ func PostReservation(res http.ResponseWriter, req *http.Request) {
 	}
 
 	decoder := json.NewDecoder(req.Body)
-	var l Lock
-	err := decoder.Decode(&l)
+	var body reservationRequest
+	err := decoder.Decode(&body)
 	if err != nil {
 		r.JSON(res, http.StatusInternalServerError, "Could not extract request body")
 		return
 	}
 
-	comment := l.Comment
+	comment := body.Comment
 	if comment == "" {
 		r.JSON(res, http.StatusInternalServerError, "No comment provided")
 		return
 	}
 
-	for _, network := range networks {
-		if network.Name == network_name {
-			ips, err := network.ExpandManaged()
-			if err != nil {
-				r.JSON(res, http.StatusInternalServerError, "Network could net be expanded")
+	network := findNetwork(network_name)
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+	if network.Container {
+		r.JSON(res, http.StatusBadRequest, errContainer.Error())
+		return
+	}
+	if !authorize(res, req, r, roleReserver, network) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), checkTimeout)
+	defer cancel()
+
+	owner := currentIdentity(req).Name
+	if body.IP != "" {
+		reserveIP(ctx, res, r, network, body.IP, comment, owner)
+		return
+	}
+
+	count, err := body.size(network.Bits())
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// an offset alone applies to the strategy of the network
+	strategy := network.Allocation
+	if body.Strategy != "" {
+		strategy = allocation{Strategy: body.Strategy, Offset: body.Offset}
+	} else if body.Offset != 0 {
+		strategy.Offset = body.Offset
+	}
+	if body.Offset != 0 && strategy.Strategy != "offset" {
+		r.JSON(res, http.StatusBadRequest, "Offset only applies to the offset strategy")
+		return
+	}
+	allocator, err := NewAllocator(strategy.Strategy, strategy.Offset)
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// candidates are taken from the cached scan and checked again right
+	// before they are reserved
+	var c *check
+	if network.Sparse() {
+		if body.Contiguous || body.Prefix != 0 {
+			c = NewCheck(network, Candidates(network, allocator, count, body.Prefix, 4))
+		} else {
+			c = NewCheck(network, Candidates(network, allocator, 1, 0, count+16))
+		}
+		c.isLocked()
+		c.getFree()
+	} else {
+		sc, err := scanner.Latest(network)
+		if err != nil {
+			r.JSON(res, http.StatusInternalServerError, "Network could net be expanded")
+			return
+		}
+		c = sc.fresh()
+	}
+
+	var free []net.IP
+	for _, status := range c.results {
+		if status.Free && status.Unmanaged == "" {
+			free = append(free, status.IP)
+		}
+	}
+	order := allocator.Order(network, free)
+
+	if body.Count == 0 && body.Prefix == 0 {
+		reserveFirst(ctx, res, r, network, order, comment, owner)
+		return
+	}
+
+	reserveMany(ctx, res, r, network, body, count, order, owner)
+}
+
+// maxVerify is the number of candidates checked at once before they are
+// reserved, and maxAttempts the number of times a block of IPs is tried.
+const (
+	maxVerify   = 8
+	maxAttempts = 4
+)
+
+// errIncomplete is returned when the live checks did not finish in time.
+var errIncomplete = errors.New("IPs could not be checked in time, please retry")
+
+// verify runs the live checks on ips of a network, bypassing the DNS
+// cache, and returns the ones which are still free and the ones which
+// could not be checked in time. The latter are never free.
+func verify(ctx context.Context, network *network, ips []net.IP) (free map[string]bool, unchecked map[string]bool) {
+	details := detailedIP{}
+	for _, ip := range ips {
+		if d, ok := network.Details(ip); ok {
+			details[ip.String()] = d
+		}
+	}
+
+	c := NewCheck(network, details)
+	c.Run(withoutCache(ctx))
+
+	free = make(map[string]bool, len(ips))
+	for ip, status := range c.results {
+		free[ip] = status.Conflict() == "" && !c.unchecked[ip]
+	}
+	return free, c.unchecked
+}
+
+// reserveFirst locks the first IP of order which passes the live checks.
+// Candidates are checked until one is free, none is left or ctx is done.
+// Candidates which could not be checked are skipped.
+func reserveFirst(ctx context.Context, res http.ResponseWriter, r *render.Render, network *network, order []net.IP, comment string, owner string) {
+	incomplete := false
+	for len(order) > 0 {
+		if ctx.Err() != nil {
+			r.JSON(res, http.StatusGatewayTimeout, "No free IP found in time, please retry")
+			return
+		}
+		batch := order
+		if len(batch) > maxVerify {
+			batch = batch[:maxVerify]
+		}
+		order = order[len(batch):]
+
+		free, unchecked := verify(ctx, network, batch)
+		if len(unchecked) > 0 {
+			incomplete = true
+		}
+		for _, ip := range batch {
+			if !free[ip.String()] {
+				continue
+			}
+			switch err := locker.Add(ip.String(), comment, owner); err {
+			case nil:
+				r.JSON(res, http.StatusOK, ip.String())
+				return
+			case ErrLocked:
+			default:
+				r.JSON(res, http.StatusInternalServerError, err.Error())
 				return
 			}
+		}
+	}
+	if incomplete {
+		r.JSON(res, http.StatusGatewayTimeout, errIncomplete.Error())
+		return
+	}
+	r.JSON(res, http.StatusConflict, "No free IP left in network")
+}
 
-			c := NewCheck(ips)
-			c.Run()
+// size returns the number of IPs requested, given the length of the
+// addresses of the network in bits.
+func (b reservationRequest) size(bits int) (int, error) {
+	count := b.Count
+	if b.Prefix != 0 {
+		if b.Prefix < 0 || b.Prefix > bits {
+			return 0, errors.New("Invalid prefix length provided")
+		}
+		if bits-b.Prefix > 16 || count > 1<<uint(bits-b.Prefix) {
+			return 0, errors.New("Count does not fit into the prefix length")
+		}
+		if count == 0 {
+			count = 1 << uint(bits-b.Prefix)
+		}
+	}
+	if count == 0 {
+		count = 1
+	}
+	if count < 0 || count > maxExpand {
+		return 0, errors.New("Invalid count provided")
+	}
+	return count, nil
+}
 
-			for ip, status := range c.results {
-				if status.Used() {
-					delete(c.results, ip)
+// reserveMany locks several IPs at once, either all of them or none.
+func reserveMany(ctx context.Context, res http.ResponseWriter, r *render.Render, network *network, body reservationRequest, count int, order []net.IP, owner string) {
+	free := make(map[string]bool, len(order))
+	for _, ip := range order {
+		free[ip.String()] = true
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var block []net.IP
+		if body.Contiguous || body.Prefix != 0 {
+			block = allocateBlock(order, free, count, body.Prefix)
+		} else {
+			for _, ip := range order {
+				if free[ip.String()] && len(block) < count {
+					block = append(block, ip)
 				}
 			}
+			if len(block) < count {
+				block = nil
+			}
+		}
+		if block == nil {
+			r.JSON(res, http.StatusConflict, "Not enough free IPs left in network")
+			return
+		}
 
-			random := rand.New(rand.NewSource(time.Now().UnixNano()))
-			elem := random.Intn(len(c.results))
+		stillFree, unchecked := verify(ctx, network, block)
+		if len(unchecked) > 0 {
+			r.JSON(res, http.StatusGatewayTimeout, errIncomplete.Error())
+			return
+		}
+		out := make([]string, len(block))
+		used := false
+		for i, ip := range block {
+			out[i] = ip.String()
+			if !stillFree[ip.String()] {
+				free[ip.String()] = false
+				used = true
+			}
+		}
+		if used {
+			continue
+		}
 
-			i := 0
-			for ip := range c.results {
-				if elem == i {
-					locker.Add(ip, comment, "")
-					r.JSON(res, http.StatusOK, ip)
-					return
-				}
-				i++
+		switch err := locker.AddMany(out, body.Comment, owner); err {
+		case nil:
+			r.JSON(res, http.StatusOK, out)
+		case ErrLocked:
+			r.JSON(res, http.StatusConflict, "IPs were reserved concurrently, please retry")
+		default:
+			r.JSON(res, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	r.JSON(res, http.StatusConflict, "No free IPs found, please retry")
+}
+
+// reserveIP locks a specific IP after running it through the same checks
+// as a randomly chosen one.
+func reserveIP(ctx context.Context, res http.ResponseWriter, r *render.Render, network *network, addr string, comment string, owner string) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		r.JSON(res, http.StatusBadRequest, "Invalid IP address provided")
+		return
+	}
+
+	d, ok := network.Details(ip)
+	if !ok {
+		r.JSON(res, http.StatusConflict, addr+" is not a host address of network "+network.Name)
+		return
+	}
+
+	c := NewCheck(network, detailedIP{ip.String(): d})
+	c.Run(withoutCache(ctx))
+	if c.unchecked[ip.String()] {
+		r.JSON(res, http.StatusGatewayTimeout, errIncomplete.Error())
+		return
+	}
+
+	if reason := c.results[ip.String()].Conflict(); reason != "" {
+		r.JSON(res, http.StatusConflict, reason)
+		return
+	}
+
+	switch err := locker.Add(ip.String(), comment, owner); err {
+	case nil:
+		r.JSON(res, http.StatusOK, ip.String())
+	case ErrLocked:
+		r.JSON(res, http.StatusConflict, addr+" is already reserved")
+	default:
+		r.JSON(res, http.StatusInternalServerError, err.Error())
+	}
+}
+
+type Reservation struct {
+	IP string `json:"ip"`
+	Lock
+	// DNSError tells why the records of a released IP could not be removed
+	DNSError string `json:"dns_error,omitempty"`
+}
+
+func GetReservations(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+
+	if !authorize(res, req, r, roleViewer, network) {
+		return
+	}
+
+	locker.Clean()
+	out := []Reservation{}
+	for ip, lock := range locker.List() {
+		if network.Contains(net.ParseIP(ip)) {
+			out = append(out, Reservation{IP: ip, Lock: lock})
+		}
+	}
+	r.JSON(res, http.StatusOK, out)
+}
+
+// errNotOwner is returned when a reservation is changed by someone else
+// than its owner.
+var errNotOwner = errors.New("Reservation belongs to someone else, only its owner or an admin may change it")
+
+func DeleteReservation(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+
+	// locks are keyed by the canonical form of the IP
+	parsed := net.ParseIP(vars["ip"])
+	if parsed == nil {
+		r.JSON(res, http.StatusBadRequest, "Invalid IP address provided")
+		return
+	}
+	ip := parsed.String()
+	if !network.Contains(parsed) {
+		r.JSON(res, http.StatusNotFound, "IP is not part of the network")
+		return
+	}
+	if !authorize(res, req, r, roleReserver, network) {
+		return
+	}
+
+	lock := locker.Get(ip)
+	if !lock.Locked() {
+		r.JSON(res, http.StatusNotFound, "IP is not reserved")
+		return
+	}
+	if !currentIdentity(req).mayChange(lock, network) {
+		r.JSON(res, http.StatusForbidden, errNotOwner.Error())
+		return
+	}
+
+	lock, err := locker.Delete(ip)
+	switch err {
+	case nil:
+		// the IP is released even if its records remain, so that a broken
+		// DNS server doesn't keep it reserved
+		reservation := Reservation{IP: ip, Lock: lock}
+		if lock.Hostname != "" && updater != nil {
+			if err := updater.Unregister(lock.Hostname, parsed); err != nil {
+				log.Printf("could not remove the DNS records of released IP %s: %v", ip, err)
+				reservation.DNSError = err.Error()
 			}
 		}
+		r.JSON(res, http.StatusOK, reservation)
+	case ErrNotLocked:
+		r.JSON(res, http.StatusNotFound, err.Error())
+	default:
+		r.JSON(res, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func PatchReservation(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+
+	// locks are keyed by the canonical form of the IP
+	parsed := net.ParseIP(vars["ip"])
+	if parsed == nil {
+		r.JSON(res, http.StatusBadRequest, "Invalid IP address provided")
+		return
+	}
+	ip := parsed.String()
+	if !network.Contains(parsed) {
+		r.JSON(res, http.StatusNotFound, "IP is not part of the network")
+		return
+	}
+	if !authorize(res, req, r, roleReserver, network) {
+		return
+	}
+
+	var body struct {
+		Minutes int `json:"minutes"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			r.JSON(res, http.StatusBadRequest, "Could not extract request body")
+			return
+		}
+	}
+
+	current := locker.Get(ip)
+	if !current.Locked() {
+		r.JSON(res, http.StatusNotFound, ErrNotLocked.Error())
+		return
+	}
+	if !currentIdentity(req).mayChange(current, network) {
+		r.JSON(res, http.StatusForbidden, errNotOwner.Error())
+		return
+	}
+
+	lock, err := locker.Extend(ip, body.Minutes)
+	switch err {
+	case nil:
+		r.JSON(res, http.StatusOK, Reservation{IP: ip, Lock: lock})
+	case ErrNotLocked:
+		r.JSON(res, http.StatusNotFound, err.Error())
+	case ErrConfirmed:
+		r.JSON(res, http.StatusConflict, err.Error())
+	default:
+		r.JSON(res, http.StatusInternalServerError, err.Error())
 	}
-	r.JSON(res, http.StatusNotFound, "No matching network found")
 }
 
+func ConfirmReservation(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+
+	// locks are keyed by the canonical form of the IP
+	parsed := net.ParseIP(vars["ip"])
+	if parsed == nil {
+		r.JSON(res, http.StatusBadRequest, "Invalid IP address provided")
+		return
+	}
+	ip := parsed.String()
+	if !network.Contains(parsed) {
+		r.JSON(res, http.StatusNotFound, "IP is not part of the network")
+		return
+	}
+	if !authorize(res, req, r, roleReserver, network) {
+		return
+	}
+
+	var body struct {
+		Hostname string `json:"hostname"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			r.JSON(res, http.StatusBadRequest, "Could not extract request body")
+			return
+		}
+	}
+
+	current := locker.Get(ip)
+	if !current.Locked() {
+		r.JSON(res, http.StatusNotFound, ErrNotLocked.Error())
+		return
+	}
+	if !currentIdentity(req).mayChange(current, network) {
+		r.JSON(res, http.StatusForbidden, errNotOwner.Error())
+		return
+	}
+	if current.Confirmed {
+		r.JSON(res, http.StatusConflict, ErrConfirmed.Error())
+		return
+	}
+	registered := false
+	if body.Hostname != "" && updater != nil {
+		if err := updater.Register(body.Hostname, parsed); err != nil {
+			r.JSON(res, http.StatusBadGateway, err.Error())
+			return
+		}
+		registered = true
+	}
+
+	lock, err := locker.Confirm(ip, body.Hostname)
+	if err != nil && registered {
+		// the reservation was not confirmed, so its records must not stay
+		if uerr := updater.Unregister(body.Hostname, parsed); uerr != nil {
+			log.Printf("could not remove the DNS records of unconfirmed IP %s: %v", ip, uerr)
+		}
+	}
+	switch err {
+	case nil:
+		r.JSON(res, http.StatusOK, Reservation{IP: ip, Lock: lock})
+	case ErrNotLocked:
+		r.JSON(res, http.StatusNotFound, err.Error())
+	case ErrConfirmed:
+		r.JSON(res, http.StatusConflict, err.Error())
+	default:
+		r.JSON(res, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func GetDNSAudit(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+	if network.Container {
+		r.JSON(res, http.StatusBadRequest, errContainer.Error())
+		return
+	}
+	if !authorize(res, req, r, roleViewer, network) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), checkTimeout)
+	defer cancel()
+
+	out, err := auditNetwork(ctx, network)
+	if err != nil {
+		r.JSON(res, http.StatusInternalServerError, "Network could not be expanded")
+		return
+	}
+	if ctx.Err() != nil {
+		res.Header().Set("X-Incomplete", "true")
+	}
+	r.JSON(res, http.StatusOK, out)
+}
+
+func GetDNSCache(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	if !authorize(res, req, r, roleViewer, nil) {
+		return
+	}
+	r.JSON(res, http.StatusOK, dnsCache.Stats(req.URL.Query().Get("name")))
+}
+
+func DeleteDNSCache(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	if !authorize(res, req, r, roleAdmin, nil) {
+		return
+	}
+	flushed := dnsCache.Flush(req.URL.Query().Get("name"))
+	r.JSON(res, http.StatusOK, map[string]int{"flushed": flushed})
+}
+
+func GetIPHistory(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	ip := net.ParseIP(vars["ip"])
+	if ip == nil {
+		r.JSON(res, http.StatusBadRequest, "Invalid IP address provided")
+		return
+	}
+	// IPs outside of all networks are only shown to global viewers
+	if !authorize(res, req, r, roleViewer, findNetwork(networkOf(ip))) {
+		return
+	}
+
+	h, ok := history.Get(ip.String())
+	if !ok {
+		r.JSON(res, http.StatusNotFound, "No history recorded for IP")
+		return
+	}
+	r.JSON(res, http.StatusOK, h)
+}
+
+// reclaimDays reads the number of days an IP has to be silent to be
+// reported as zombie DNS, 30 by default.
+func reclaimDays(req *http.Request) (int, error) {
+	days := req.URL.Query().Get("days")
+	if days == "" {
+		return 30, nil
+	}
+	d, err := strconv.Atoi(days)
+	if err != nil || d < 0 {
+		return 0, errors.New("Invalid number of days provided")
+	}
+	return d, nil
+}
+
+func GetNetworkReclaim(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	network := findNetwork(vars["net"])
+	if network == nil {
+		r.JSON(res, http.StatusNotFound, "No matching network found")
+		return
+	}
+	if network.Container {
+		r.JSON(res, http.StatusBadRequest, errContainer.Error())
+		return
+	}
+
+	if !authorize(res, req, r, roleViewer, network) {
+		return
+	}
+
+	days, err := reclaimDays(req)
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sc, err := scanner.Latest(network)
+	if err != nil {
+		r.JSON(res, http.StatusInternalServerError, "Network could not be expanded")
+		return
+	}
+	rep := newReclaimReport(days)
+	rep.add(network, sc)
+	rep.sort()
+	r.JSON(res, http.StatusOK, rep)
+}
+
+func GetReclaim(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	days, err := reclaimDays(req)
+	if err != nil {
+		r.JSON(res, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rep := newReclaimReport(days)
+	for _, network := range visible(req, getNetworks()) {
+		if network.Container {
+			continue
+		}
+		// scanning all networks would take too long, so networks are only
+		// reported on once the background scan got to them
+		rep.add(network, scanner.Get(network.Name))
+	}
+	rep.sort()
+	r.JSON(res, http.StatusOK, rep)
+}
+
+// GetStats returns the usage of all networks, or only of one kind of
+// group (global, dcs, vlans or supernets), or of a single group of it.
+func GetStats(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	vars := mux.Vars(req)
+
+	s := collectStats(visible(req, getNetworks()))
+	if vars["kind"] == "" {
+		r.JSON(res, http.StatusOK, s)
+		return
+	}
+
+	var groups map[string]*usage
+	switch vars["kind"] {
+	case "global":
+		if vars["name"] != "" {
+			r.JSON(res, http.StatusNotFound, "No matching group found")
+			return
+		}
+		r.JSON(res, http.StatusOK, s.Global)
+		return
+	case "dcs":
+		groups = s.DCs
+	case "vlans":
+		groups = s.VLANs
+	case "supernets":
+		groups = s.Supernets
+	default:
+		r.JSON(res, http.StatusNotFound, "Unknown kind of group, use global, dcs, vlans or supernets")
+		return
+	}
+
+	if vars["name"] == "" {
+		r.JSON(res, http.StatusOK, groups)
+		return
+	}
+	u, ok := groups[vars["name"]]
+	if !ok {
+		r.JSON(res, http.StatusNotFound, "No matching group found")
+		return
+	}
+	r.JSON(res, http.StatusOK, u)
+}
+
+func GetMetrics(res http.ResponseWriter, req *http.Request) {
+	if !authorize(res, req, render.New(), roleViewer, nil) {
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Write(res)
+}
+
+func GetAlerts(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	id := currentIdentity(req)
+	out := []alertState{}
+	for _, state := range alerts.Active() {
+		if id.can(roleViewer, findNetwork(state.Network)) {
+			out = append(out, state)
+		}
+	}
+	r.JSON(res, http.StatusOK, out)
+}
+
+// PostAlertTest sends a sample alert about the network given with
+// ?network=, or about an example network, to all webhooks.
+func PostAlertTest(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+
+	if len(alerts.Webhooks) == 0 {
+		r.JSON(res, http.StatusBadRequest, "No webhooks configured")
+		return
+	}
+
+	n := &network{Name: "example", CIDR: "192.0.2.0/24"}
+	var scope *network
+	if name := req.URL.Query().Get("network"); name != "" {
+		if n = findNetwork(name); n == nil {
+			r.JSON(res, http.StatusNotFound, "No matching network found")
+			return
+		}
+		scope = n
+	}
+	if !authorize(res, req, r, roleNetworkAdmin, scope) {
+		return
+	}
+
+	results := alerts.Test(n)
+	for _, result := range results {
+		if result.Error != "" {
+			r.JSON(res, http.StatusBadGateway, results)
+			return
+		}
+	}
+	r.JSON(res, http.StatusOK, results)
+}
+
+// GetWhoami returns the user making the request, its roles and what they
+// allow on each network.
+func GetWhoami(res http.ResponseWriter, req *http.Request) {
+	r := render.New()
+	r.JSON(res, http.StatusOK, currentIdentity(req).effective(getNetworks()))
+}
+
+// GetConfig returns the configuration, which only admins may see as it
+// tells where credentials are kept.
 func GetConfig(res http.ResponseWriter, req *http.Request) {
 	r := render.New()
+	if !authorize(res, req, r, roleAdmin, nil) {
+		return
+	}
 	r.JSON(res, http.StatusOK, config)
 }
 
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxEvents is the number of events kept per IP.
+const maxEvents = 100
+
+// IPHistory records how an IP was seen by the scans over time.
+type IPHistory struct {
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastPTR   time.Time `json:"last_ptr"`
+	Pingable  bool      `json:"pingable"`
+	Name      string    `json:"name"`
+	Events    []IPEvent `json:"events"`
+}
+
+// IPEvent is a state transition of an IP. Type is one of "pingable",
+// "unpingable", "ptr_changed" or "reservation_" followed by the type of a
+// LockEvent.
+type IPEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func (h *IPHistory) add(at time.Time, typ string, detail string) {
+	h.Events = append(h.Events, IPEvent{Time: at, Type: typ, Detail: detail})
+	if len(h.Events) > maxEvents {
+		h.Events = h.Events[len(h.Events)-maxEvents:]
+	}
+}
+
+// History keeps the IPHistory of every IP which was ever seen in use.
+type History struct {
+	sync.RWMutex
+	journal *journal
+	ips     map[string]*IPHistory
+}
+
+func (h *History) Init(spec string) error {
+	path, err := storePath(spec)
+	if err != nil {
+		return err
+	}
+	h.journal = &journal{path: path}
+	if err := h.journal.open(); err != nil {
+		return err
+	}
+
+	h.ips = make(map[string]*IPHistory)
+	h.journal.Each(func(ip string, value json.RawMessage) {
+		var ih IPHistory
+		if err := json.Unmarshal(value, &ih); err != nil {
+			log.Printf("%s: ignoring history of %s: %v", path, ip, err)
+			return
+		}
+		h.ips[ip] = &ih
+	})
+	return nil
+}
+
+func (h *History) Close() error {
+	return h.journal.Close()
+}
+
+// Get returns a copy of the history of an IP.
+func (h *History) Get(ip string) (IPHistory, bool) {
+	h.RLock()
+	defer h.RUnlock()
+
+	ih, ok := h.ips[ip]
+	if !ok {
+		return IPHistory{}, false
+	}
+	out := *ih
+	out.Events = append([]IPEvent{}, ih.Events...)
+	return out, true
+}
+
+// Record updates the history with the results of a scan finished at the
+// given time.
+func (h *History) Record(results map[string]*ResultSet, at time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	updated := map[string]interface{}{}
+	for ip, r := range results {
+		ih, ok := h.ips[ip]
+		if !ok {
+			if !r.Pingable && r.Name == "" {
+				continue
+			}
+			ih = &IPHistory{IP: ip, FirstSeen: at}
+			h.ips[ip] = ih
+		}
+		changed := !ok
+		if ih.FirstSeen.IsZero() && (r.Pingable || r.Name != "") {
+			ih.FirstSeen = at
+			changed = true
+		}
+
+		if r.Pingable != ih.Pingable {
+			if r.Pingable {
+				ih.add(at, "pingable", "")
+			} else {
+				ih.add(at, "unpingable", "")
+			}
+			ih.Pingable = r.Pingable
+			changed = true
+		}
+		if r.Name != ih.Name {
+			ih.add(at, "ptr_changed", ih.Name+" -> "+r.Name)
+			ih.Name = r.Name
+			changed = true
+		}
+		if r.Pingable {
+			ih.LastSeen = at
+			changed = true
+		}
+		if r.Name != "" {
+			ih.LastPTR = at
+			changed = true
+		}
+		// only IPs whose history changed are written to the journal
+		if changed {
+			updated[ip] = ih
+		}
+	}
+
+	if err := h.journal.Put(updated); err != nil {
+		log.Printf("could not persist history: %v", err)
+	}
+}
+
+// RecordLock adds an event for a change of a lock to the history.
+func (h *History) RecordLock(e LockEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	ih, ok := h.ips[e.IP]
+	if !ok {
+		ih = &IPHistory{IP: e.IP}
+		h.ips[e.IP] = ih
+	}
+	ih.add(e.Time, "reservation_"+e.Type, e.Lock.Comment)
+
+	if err := h.journal.Put(map[string]interface{}{e.IP: ih}); err != nil {
+		log.Printf("could not persist history of %s: %v", e.IP, err)
+	}
+}
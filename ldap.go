@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapTimeout is the time a directory has to answer a bind.
+const ldapTimeout = 10 * time.Second
+
+// ldapAuth authenticates users with a simple bind to a directory, as the DN
+// of the user built from DN, in which %s is replaced by the escaped name.
+type ldapAuth struct {
+	Addr string
+	TLS  bool
+	DN   string
+}
+
+// newLDAPAuth takes the URL of the directory, ldap://<host>[:port] or
+// ldaps://<host>[:port], and the template of the DNs of users.
+func newLDAPAuth(rawurl string, dn string) (*ldapAuth, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q, expected ldap://<host>[:port] or ldaps://<host>[:port]", rawurl)
+	}
+	if strings.Count(dn, "%s") != 1 {
+		return nil, fmt.Errorf("invalid LDAP DN %q, expected one %%s for the user name", dn)
+	}
+
+	a := &ldapAuth{Addr: u.Host, TLS: u.Scheme == "ldaps", DN: dn}
+	if u.Port() == "" {
+		port := "389"
+		if a.TLS {
+			port = "636"
+		}
+		a.Addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	return a, nil
+}
+
+// escapeDN escapes the characters with a meaning in DNs, RFC 4514.
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i, c := range []byte(s) {
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ber encodes an element with tag and contents.
+func ber(tag byte, contents ...[]byte) []byte {
+	var body []byte
+	for _, c := range contents {
+		body = append(body, c...)
+	}
+	out := []byte{tag}
+	if n := len(body); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, body...)
+}
+
+// readBER reads an element, returning its tag and contents.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 3 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	contents := make([]byte, n)
+	if _, err := io.ReadFull(r, contents); err != nil {
+		return 0, nil, err
+	}
+	return tag, contents, nil
+}
+
+// LDAP result codes of a bind.
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+func (a *ldapAuth) Authenticate(user string, password string) (bool, error) {
+	// a bind without password is anonymous and always succeeds
+	if user == "" || password == "" {
+		return false, nil
+	}
+
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	var err error
+	if a.TLS {
+		host, _, _ := net.SplitHostPort(a.Addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", a.Addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", a.Addr)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	// LDAPMessage { messageID 1, BindRequest { version 3, name, simple } }
+	dn := fmt.Sprintf(a.DN, escapeDN(user))
+	request := ber(0x30,
+		ber(0x02, []byte{1}),
+		ber(0x60,
+			ber(0x02, []byte{3}),
+			ber(0x04, []byte(dn)),
+			ber(0x80, []byte(password))))
+	if _, err := conn.Write(request); err != nil {
+		return false, err
+	}
+
+	tag, message, err := readBER(bufio.NewReader(conn))
+	if err != nil {
+		return false, err
+	}
+	r := bufio.NewReader(bytes.NewReader(message))
+	if _, _, err := readBER(r); tag != 0x30 || err != nil {
+		return false, errors.New("invalid LDAP response")
+	}
+	tag, response, err := readBER(r)
+	if err != nil || tag != 0x61 {
+		return false, errors.New("invalid LDAP bind response")
+	}
+	tag, code, err := readBER(bufio.NewReader(bytes.NewReader(response)))
+	if err != nil || tag != 0x0a || len(code) == 0 {
+		return false, errors.New("invalid LDAP bind response")
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+
+	switch result {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	}
+	return false, fmt.Errorf("LDAP bind failed with result code %d", result)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewLDAPAuth(t *testing.T) {
+	tests := []struct {
+		url     string
+		dn      string
+		addr    string
+		tls     bool
+		wantErr bool
+	}{
+		{"ldap://ldap.example.com", "uid=%s,dc=example", "ldap.example.com:389", false, false},
+		{"ldaps://ldap.example.com", "uid=%s,dc=example", "ldap.example.com:636", true, false},
+		{"ldap://ldap.example.com:1389", "uid=%s,dc=example", "ldap.example.com:1389", false, false},
+		{"ldaps://[2001:db8::1]", "uid=%s,dc=example", "[2001:db8::1]:636", true, false},
+		{"http://ldap.example.com", "uid=%s,dc=example", "", false, true},
+		{"ldap://", "uid=%s,dc=example", "", false, true},
+		{"ldap://ldap.example.com", "dc=example", "", false, true},
+		{"ldap://ldap.example.com", "uid=%s,cn=%s", "", false, true},
+	}
+	for _, tt := range tests {
+		a, err := newLDAPAuth(tt.url, tt.dn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s %s: error %v, want error %v", tt.url, tt.dn, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (a.Addr != tt.addr || a.TLS != tt.tls) {
+			t.Errorf("%s: got %s, TLS %v, want %s, TLS %v", tt.url, a.Addr, a.TLS, tt.addr, tt.tls)
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := map[string]string{
+		"alice":        "alice",
+		"smith, john":  `smith\, john`,
+		`a+b"c\d<e>;=`: `a\+b\"c\\d\<e\>\;\=`,
+		" lead":        `\ lead`,
+		"trail ":       `trail\ `,
+		"#hash#":       `\#hash#`,
+		"nul\x00":      `nul\00`,
+	}
+	for in, want := range tests {
+		if got := escapeDN(in); got != want {
+			t.Errorf("escapeDN(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBERLength(t *testing.T) {
+	for _, n := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0x10000} {
+		b := ber(0x04, make([]byte, n))
+		tag, contents, err := readBER(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || tag != 0x04 || len(contents) != n {
+			t.Errorf("%d bytes: read tag %#x, %d bytes, %v", n, tag, len(contents), err)
+		}
+	}
+	if got := hex.EncodeToString(ber(0x04, make([]byte, 0x100))[:4]); got != "04820100" {
+		t.Errorf("long form of 256 = %s, want 04820100", got)
+	}
+}
+
+// fakeLDAP accepts a single connection, checks the bind request on it and
+// answers with response.
+func fakeLDAP(t *testing.T, request []byte, response []byte) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tag, contents, err := readBER(bufio.NewReader(conn))
+		if err != nil {
+			t.Errorf("reading the request: %v", err)
+			return
+		}
+		if got := ber(tag, contents); !bytes.Equal(got, request) {
+			t.Errorf("request = %x, want %x", got, request)
+		}
+		conn.Write(response)
+	}()
+	return l.Addr().String()
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	// LDAPMessage { messageID 1, BindRequest { version 3,
+	// "uid=alice,ou=people,dc=example,dc=com", simple "secret" } }
+	request := fromHex(t, "3037"+"020101"+"6032"+"020103"+
+		"0425"+hex.EncodeToString([]byte("uid=alice,ou=people,dc=example,dc=com"))+
+		"8006"+hex.EncodeToString([]byte("secret")))
+	// LDAPMessage { messageID 1, BindResponse { resultCode, "", "" } }
+	response := func(code string) []byte {
+		return fromHex(t, "300c"+"020101"+"6107"+"0a01"+code+"0400"+"0400")
+	}
+
+	tests := []struct {
+		name     string
+		response []byte
+		ok       bool
+		wantErr  bool
+	}{
+		{"success", response("00"), true, false},
+		{"invalid credentials", response("31"), false, false},
+		{"unwilling to perform", response("35"), false, true},
+		{"not a bind response", fromHex(t, "300c"+"020101"+"6507"+"0a0100"+"0400"+"0400"), false, true},
+		{"garbage", []byte("HTTP/1.1 400 Bad Request\r\n\r\n"), false, true},
+	}
+	for _, tt := range tests {
+		addr := fakeLDAP(t, request, tt.response)
+		a := &ldapAuth{Addr: addr, DN: "uid=%s,ou=people,dc=example,dc=com"}
+		ok, err := a.Authenticate("alice", "secret")
+		if ok != tt.ok || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %v, %v, want %v, error %v", tt.name, ok, err, tt.ok, tt.wantErr)
+		}
+	}
+}
+
+func TestLDAPAuthenticateAnonymous(t *testing.T) {
+	// nothing listens there, an empty password must not even connect
+	a := &ldapAuth{Addr: "127.0.0.1:1", DN: "uid=%s"}
+	for _, creds := range [][2]string{{"alice", ""}, {"", "secret"}} {
+		if ok, err := a.Authenticate(creds[0], creds[1]); ok || err != nil {
+			t.Errorf("%q: got %v, %v, want a refusal without error", strings.Join(creds[:], ":"), ok, err)
+		}
+	}
+}
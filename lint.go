@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// issue is an error or a warning about the network definitions, found at
+// Line of the file, or 0 if the line is unknown.
+type issue struct {
+	Line     int    `json:"line"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// format describes the issue like a compiler would.
+func (i issue) format(path string) string {
+	if i.Line == 0 {
+		return fmt.Sprintf("%s: %s: %s", path, i.Severity, i.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", path, i.Line, i.Severity, i.Message)
+}
+
+// countErrors returns the number of issues which are errors.
+func countErrors(issues []issue) int {
+	n := 0
+	for _, i := range issues {
+		if i.Severity == severityError {
+			n++
+		}
+	}
+	return n
+}
+
+// definitionLines locates the networks and their fields in the text of the
+// definitions, as the YAML decoder does not tell where values come from.
+type definitionLines struct {
+	lines []string
+	// starts holds the index of the line every network starts at.
+	starts []int
+}
+
+func newDefinitionLines(data []byte) *definitionLines {
+	d := &definitionLines{lines: strings.Split(string(data), "\n")}
+	top := -1
+	for i := range d.lines {
+		indent, rest := d.split(i)
+		if !isItem(rest) {
+			continue
+		}
+		if top < 0 || indent < top {
+			top = indent
+			d.starts = nil
+		}
+		if indent == top {
+			d.starts = append(d.starts, i)
+		}
+	}
+	return d
+}
+
+// split returns the indentation of line i and its text. Blank lines and
+// comments have no text.
+func (d *definitionLines) split(i int) (int, string) {
+	line := d.lines[i]
+	rest := strings.TrimLeft(line, " ")
+	if strings.HasPrefix(rest, "#") {
+		rest = ""
+	}
+	return len(line) - len(rest), strings.TrimRight(rest, " \r")
+}
+
+func isItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// key returns the column of the key on line i, looking past the dash of
+// sequence items, and the key itself.
+func (d *definitionLines) key(i int) (int, string) {
+	indent, rest := d.split(i)
+	for isItem(rest) {
+		trimmed := strings.TrimLeft(rest[1:], " ")
+		indent += len(rest) - len(trimmed)
+		rest = trimmed
+	}
+	colon := strings.Index(rest, ":")
+	if colon < 0 || (colon+1 < len(rest) && rest[colon+1] != ' ') {
+		return indent, ""
+	}
+	return indent, strings.Trim(rest[:colon], `"'`)
+}
+
+// Line returns the line of the field of the network at index i, like
+// "dhcp.1" for its second DHCP range, or of the closest parent found.
+// Fields are dot separated, indexes of sequences are numbers. It returns 0
+// if the network itself can't be found.
+func (d *definitionLines) Line(i int, field string) int {
+	if i < 0 || i >= len(d.starts) {
+		return 0
+	}
+	end := len(d.lines)
+	if i+1 < len(d.starts) {
+		end = d.starts[i+1]
+	}
+
+	line := d.starts[i]
+	col, _ := d.key(line)
+	if field == "" {
+		return line + 1
+	}
+
+	for _, part := range strings.Split(field, ".") {
+		found := -1
+		if index, err := strconv.Atoi(part); err == nil {
+			count, itemIndent := -1, -1
+			for j := line + 1; j < end && found < 0; j++ {
+				indent, rest := d.split(j)
+				if rest == "" {
+					continue
+				}
+				if indent < col || (indent == col && !isItem(rest)) {
+					break
+				}
+				if !isItem(rest) {
+					continue
+				}
+				if itemIndent < 0 {
+					itemIndent = indent
+				}
+				if indent == itemIndent {
+					if count++; count == index {
+						found = j
+					}
+				}
+			}
+		} else {
+			if line != d.starts[i] {
+				// the keys of a nested map are on the lines below its key
+				for j := line + 1; j < end; j++ {
+					if _, rest := d.split(j); rest != "" {
+						if c, _ := d.key(j); c > col {
+							col = c
+						}
+						break
+					}
+				}
+			}
+			for j := line; j < end && found < 0; j++ {
+				indent, rest := d.split(j)
+				if rest == "" {
+					continue
+				}
+				if j > line && indent < col {
+					break
+				}
+				if c, key := d.key(j); c == col && key == part {
+					found = j
+				}
+			}
+		}
+		if found < 0 {
+			break
+		}
+		line = found
+		col, _ = d.key(line)
+	}
+	return line + 1
+}
+
+// find returns the line of the first value which is value, or 0.
+func (d *definitionLines) find(value string) int {
+	for i := range d.lines {
+		_, rest := d.split(i)
+		if colon := strings.Index(rest, ": "); colon >= 0 {
+			rest = rest[colon+2:]
+		} else if isItem(rest) {
+			rest = rest[1:]
+		} else {
+			continue
+		}
+		if strings.Trim(strings.TrimSpace(rest), `"'`) == value {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+var yamlLine = regexp.MustCompile(`line (\d+): (.*)`)
+
+// yamlIssues turns the errors of the YAML decoder into issues. Errors of
+// values which failed to decode themselves, like IPs, come without a line,
+// it is the first one holding the value.
+func yamlIssues(err error, data []byte) []issue {
+	lines := newDefinitionLines(data)
+	var out []issue
+	for _, msg := range strings.Split(err.Error(), "\n") {
+		msg = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(msg), "yaml:"))
+		if msg == "" || msg == "unmarshal errors:" {
+			continue
+		}
+		i := issue{Severity: severityError, Message: msg}
+		if m := yamlLine.FindStringSubmatch(msg); m != nil {
+			i.Line, _ = strconv.Atoi(m[1])
+			i.Message = m[2]
+		} else if colon := strings.LastIndex(msg, ": "); colon >= 0 {
+			i.Line = lines.find(msg[colon+2:])
+		}
+		out = append(out, i)
+	}
+	return out
+}
+
+// unknownFields warns about the fields of def which are not part of t, as
+// they are most likely typos.
+func unknownFields(def yaml.MapSlice, t reflect.Type, path string, warn func(field string, format string, args ...interface{})) {
+	known := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := strings.Split(f.Tag.Get("yaml"), ",")[0]; name != "" && name != "-" {
+			known[name] = f.Type
+		}
+	}
+	for _, item := range def {
+		key := fmt.Sprint(item.Key)
+		field := key
+		if path != "" {
+			field = path + "." + key
+		}
+		ft, ok := known[key]
+		if !ok {
+			warn(field, "unknown field %q is ignored", field)
+			continue
+		}
+		switch value := item.Value.(type) {
+		case yaml.MapSlice:
+			if ft.Kind() == reflect.Struct {
+				unknownFields(value, ft, field, warn)
+			}
+		case []interface{}:
+			if ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct {
+				for i, v := range value {
+					if m, ok := v.(yaml.MapSlice); ok {
+						unknownFields(m, ft.Elem(), field+"."+strconv.Itoa(i), warn)
+					}
+				}
+			}
+		}
+	}
+}
+
+// rangeOverlaps reports whether two ranges share addresses.
+func rangeOverlaps(a, b rng) bool {
+	return compareIP(a.Start, b.End) <= 0 && compareIP(b.Start, a.End) <= 0
+}
+
+// lintDefinitions decodes the network definitions in data and checks them,
+// returning the networks and the issues found, sorted by line. The networks
+// must not be used if any of the issues is an error.
+func lintDefinitions(data []byte) ([]*network, []issue) {
+	list, err := ReadNetworks(data)
+	if err != nil {
+		return nil, yamlIssues(err, data)
+	}
+	var defs []yaml.MapSlice
+	yaml.Unmarshal(data, &defs)
+	lines := newDefinitionLines(data)
+
+	var out []issue
+	report := func(severity string, i int) func(string, string, ...interface{}) {
+		return func(field string, format string, args ...interface{}) {
+			out = append(out, issue{
+				Line:     lines.Line(i, field),
+				Severity: severity,
+				Message:  fmt.Sprintf(format, args...),
+			})
+		}
+	}
+
+	for i, n := range list {
+		fail, warn := report(severityError, i), report(severityWarning, i)
+		if n == nil {
+			fail("", "network %d is empty", i+1)
+			continue
+		}
+		if i < len(defs) {
+			unknownFields(defs[i], reflect.TypeOf(*n), "", func(field string, format string, args ...interface{}) {
+				warn(field, "network %s: "+format, append([]interface{}{n.Name}, args...)...)
+			})
+		}
+		for _, p := range n.problems() {
+			fail(p.Field, "%s", p.Message)
+		}
+
+		ranges := append([]rng{}, n.DHCP...)
+		for _, f := range n.ForeignRanges {
+			ranges = append(ranges, f.Rng)
+		}
+		for j, r := range ranges {
+			field := fmt.Sprintf("dhcp.%d", j)
+			if j >= len(n.DHCP) {
+				field = fmt.Sprintf("foreign_ranges.%d", j-len(n.DHCP))
+			}
+			if r.Start == nil || r.End == nil {
+				continue
+			}
+			for _, o := range ranges[:j] {
+				if o.Start != nil && o.End != nil && rangeOverlaps(r, o) {
+					warn(field, "network %s: range %v-%v overlaps with range %v-%v", n.Name, r.Start, r.End, o.Start, o.End)
+				}
+			}
+			if j < len(n.DHCP) && n.Gateway != nil && r.Contains(n.Gateway) {
+				warn(field, "network %s: gateway %v is part of dhcp range %v-%v", n.Name, n.Gateway, r.Start, r.End)
+			}
+		}
+
+		for j, o := range list[:i] {
+			if o == nil {
+				continue
+			}
+			if o.Name == n.Name {
+				fail("name", "network %s is defined twice, first on line %d", n.Name, lines.Line(j, "name"))
+			}
+			if n.Conflicts(*o) {
+				fail("cidr", "network %s overlaps with network %s on line %d", n.Name, o.Name, lines.Line(j, "cidr"))
+			}
+			// IPv4 and IPv6 networks of the same segment share their VLAN
+			if n.Vlan.Id != 0 && n.Vlan.Id == o.Vlan.Id && n.DC == o.DC && n.Bits() == o.Bits() {
+				warn("vlan.id", "network %s uses VLAN %d in data center %q like network %s on line %d", n.Name, n.Vlan.Id, n.DC, o.Name, lines.Line(j, "vlan.id"))
+			}
+		}
+	}
+
+	// parents may be defined after their networks
+	for i, n := range list {
+		if n == nil {
+			continue
+		}
+		if err := n.checkParent(list); err != nil {
+			report(severityError, i)("parent", "%v", err)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Line < out[j].Line
+	})
+	return list, out
+}
+
+// lintFile checks the network definitions in the file at path.
+func lintFile(path string) ([]*network, []issue, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, issues := lintDefinitions(b)
+	return list, issues, nil
+}
+
+// validateCommand checks the network definitions in the files given as
+// args, or in config.File if there are none, and prints the issues found.
+// It returns the exit code, 1 if any file has errors.
+func validateCommand(args []string) int {
+	if len(args) == 0 {
+		args = []string{config.File}
+	}
+	code := 0
+	for _, path := range args {
+		_, issues, err := lintFile(path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		for _, i := range issues {
+			fmt.Println(i.format(path))
+		}
+		errors := countErrors(issues)
+		if errors > 0 {
+			code = 1
+		}
+		fmt.Printf("%s: %d errors, %d warnings\n", path, errors, len(issues)-errors)
+	}
+	return code
+}
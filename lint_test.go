@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+const testDefinitions = `# networks of dc1
+- name: first
+  cidr: 192.0.2.0/24
+  vlan:
+    name: servers
+    id: 10
+  dhcp:
+    - start: 192.0.2.100
+      end: 192.0.2.150
+
+    # second range
+    - start: 192.0.2.200
+      end: 192.0.2.250
+-   name: second
+    cidr: 198.51.100.0/24
+    dhcp:
+    - start: 198.51.100.10
+      end: 198.51.100.20
+    tags: [web]
+`
+
+func TestDefinitionLinesLine(t *testing.T) {
+	d := newDefinitionLines([]byte(testDefinitions))
+	tests := []struct {
+		network int
+		field   string
+		want    int
+	}{
+		{0, "", 2},
+		{0, "name", 2},
+		{0, "cidr", 3},
+		{0, "vlan", 4},
+		{0, "vlan.id", 6},
+		{0, "dhcp", 7},
+		{0, "dhcp.0", 8},
+		{0, "dhcp.0.end", 9},
+		{0, "dhcp.1", 12},
+		{0, "dhcp.1.end", 13},
+		// the closest parent which is found
+		{0, "dhcp.2", 7},
+		{0, "vlan.mtu", 4},
+		{0, "gateway", 2},
+		{1, "", 14},
+		{1, "cidr", 15},
+		{1, "dhcp.0", 17},
+		{1, "dhcp.0.end", 18},
+		{1, "tags", 19},
+		{2, "cidr", 0},
+		{-1, "", 0},
+	}
+	for _, tt := range tests {
+		if got := d.Line(tt.network, tt.field); got != tt.want {
+			t.Errorf("Line(%d, %q) = %d, want %d", tt.network, tt.field, got, tt.want)
+		}
+	}
+}
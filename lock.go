@@ -1,6 +1,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 )
@@ -9,55 +12,228 @@ type Lock struct {
 	Comment     string    `json:"comment"`
 	Owner       string    `json:"owner"`
 	LockedUntil time.Time `json:"locked_until"`
+	Confirmed   bool      `json:"confirmed"`
+	Hostname    string    `json:"hostname,omitempty"`
 }
 
 func (l *Lock) Locked() bool {
 	return l.Comment != "" || l.Owner != ""
 }
 
+// Expired reports whether a temporary lock ran out, even if Clean did not
+// remove it yet.
+func (l *Lock) Expired(now time.Time) bool {
+	return !l.Confirmed && l.LockedUntil.Before(now)
+}
+
+var (
+	ErrLocked    = errors.New("IP is already reserved")
+	ErrNotLocked = errors.New("IP is not reserved")
+	ErrConfirmed = errors.New("reservation is already confirmed")
+)
+
+// LockEvent describes a change of a lock. Type is one of "created",
+// "released", "extended", "confirmed" or "expired".
+type LockEvent struct {
+	Type string
+	IP   string
+	Lock Lock
+	Time time.Time
+}
+
 type Locker struct {
 	sync.RWMutex
-	locks map[string]Lock
-	ver   int64
-	dur   int
+	locks     map[string]Lock
+	store     LockStore
+	listeners []func(LockEvent)
+	ver       int64
+	dur       int
 }
 
-func (l *Locker) Init(duration int) {
+// Subscribe registers fn to be called on every change of a lock. fn is
+// called while the Locker is locked and must not call back into it.
+func (l *Locker) Subscribe(fn func(LockEvent)) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.listeners = append(l.listeners, fn)
+}
+
+func (l *Locker) notify(typ string, ip string, lock Lock) {
+	e := LockEvent{Type: typ, IP: ip, Lock: lock, Time: time.Now()}
+	for _, fn := range l.listeners {
+		fn(e)
+	}
+}
+
+func (l *Locker) Init(duration int, store LockStore) error {
 	l.dur = duration
 	l.ver = 0
-	l.locks = make(map[string]Lock)
+	l.store = store
+
+	locks, err := store.Load()
+	if err != nil {
+		return err
+	}
+	l.locks = locks
+	l.Clean()
+	return nil
 }
 
-func (l *Locker) Add(ip string, comment string, owner string) bool {
+// Add locks ip. It fails with ErrLocked if ip is locked already, or with
+// the error of the store if the lock could not be persisted.
+func (l *Locker) Add(ip string, comment string, owner string) error {
 	l.Lock()
 	defer l.Unlock()
 
-	if _, ok := l.locks[ip]; !ok {
-		lock := Lock{
-			Comment:     comment,
-			Owner:       owner,
-			LockedUntil: time.Now().Add(time.Duration(l.dur) * time.Minute),
+	old, ok := l.locks[ip]
+	if ok && !old.Expired(time.Now()) {
+		return ErrLocked
+	}
+	lock := Lock{
+		Comment:     comment,
+		Owner:       owner,
+		LockedUntil: time.Now().Add(time.Duration(l.dur) * time.Minute),
+	}
+
+	if err := l.store.Put(ip, lock); err != nil {
+		return fmt.Errorf("could not persist lock for %s: %v", ip, err)
+	}
+	if ok {
+		l.notify("expired", ip, old)
+	}
+	l.locks[ip] = lock
+	l.ver++
+	l.notify("created", ip, lock)
+	return nil
+}
+
+// AddMany locks all given IPs or none of them.
+func (l *Locker) AddMany(ips []string, comment string, owner string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for _, ip := range ips {
+		if old, ok := l.locks[ip]; ok && !old.Expired(now) {
+			return ErrLocked
 		}
+	}
 
+	lock := Lock{
+		Comment:     comment,
+		Owner:       owner,
+		LockedUntil: time.Now().Add(time.Duration(l.dur) * time.Minute),
+	}
+	locks := make(map[string]Lock, len(ips))
+	for _, ip := range ips {
+		locks[ip] = lock
+	}
+	if err := l.store.PutMany(locks); err != nil {
+		return fmt.Errorf("could not persist locks: %v", err)
+	}
+	for _, ip := range ips {
+		if old, ok := l.locks[ip]; ok {
+			l.notify("expired", ip, old)
+		}
 		l.locks[ip] = lock
-		l.ver = +1
-		return true
+		l.notify("created", ip, lock)
 	}
-	return false
+	l.ver++
+	return nil
 }
 
-func (l *Locker) Delete(ip string) {
+// Delete unlocks ip. The lock is kept if its removal could not be
+// persisted, so it doesn't come back after a restart.
+func (l *Locker) Delete(ip string) (Lock, error) {
 	l.Lock()
 	defer l.Unlock()
 
+	lock, ok := l.locks[ip]
+	if !ok || lock.Expired(time.Now()) {
+		return Lock{}, ErrNotLocked
+	}
+	if err := l.store.Delete(ip); err != nil {
+		return lock, fmt.Errorf("could not persist removal of lock for %s: %v", ip, err)
+	}
 	delete(l.locks, ip)
+	l.notify("released", ip, lock)
+	return lock, nil
+}
+
+// Extend pushes the expiry of a temporary lock to the given number of
+// minutes from now. A duration of 0 uses the default lock duration.
+func (l *Locker) Extend(ip string, minutes int) (Lock, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	lock, ok := l.locks[ip]
+	if !ok || lock.Expired(time.Now()) {
+		return Lock{}, ErrNotLocked
+	}
+	if lock.Confirmed {
+		return lock, ErrConfirmed
+	}
+	if minutes <= 0 {
+		minutes = l.dur
+	}
+
+	lock.LockedUntil = time.Now().Add(time.Duration(minutes) * time.Minute)
+	if err := l.store.Put(ip, lock); err != nil {
+		return l.locks[ip], err
+	}
+	l.locks[ip] = lock
+	l.ver++
+	l.notify("extended", ip, lock)
+	return lock, nil
+}
+
+// Confirm turns a temporary lock into a permanent assignment to hostname,
+// which is no longer removed by Clean.
+func (l *Locker) Confirm(ip string, hostname string) (Lock, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	lock, ok := l.locks[ip]
+	if !ok || lock.Expired(time.Now()) {
+		return Lock{}, ErrNotLocked
+	}
+	if lock.Confirmed {
+		return lock, ErrConfirmed
+	}
+
+	lock.Confirmed = true
+	lock.Hostname = hostname
+	lock.LockedUntil = time.Time{}
+	if err := l.store.Put(ip, lock); err != nil {
+		return l.locks[ip], err
+	}
+	l.locks[ip] = lock
+	l.ver++
+	l.notify("confirmed", ip, lock)
+	return lock, nil
 }
 
 func (l *Locker) Get(ip string) Lock {
 	l.RLock()
 	defer l.RUnlock()
 
-	return l.locks[ip]
+	if lock := l.locks[ip]; !lock.Expired(time.Now()) {
+		return lock
+	}
+	return Lock{}
+}
+
+// List returns a copy of all locks, keyed by IP.
+func (l *Locker) List() map[string]Lock {
+	l.RLock()
+	defer l.RUnlock()
+
+	out := make(map[string]Lock, len(l.locks))
+	for ip, lock := range l.locks {
+		out[ip] = lock
+	}
+	return out
 }
 
 func (l *Locker) Clean() {
@@ -65,8 +241,15 @@ func (l *Locker) Clean() {
 	defer l.Unlock()
 
 	for ip, lock := range l.locks {
-		if lock.LockedUntil.Before(time.Now()) {
+		if lock.Expired(time.Now()) {
+			// keep it until the removal is persisted, the next Clean
+			// tries again
+			if err := l.store.Delete(ip); err != nil {
+				log.Printf("could not persist removal of lock for %s: %v", ip, err)
+				continue
+			}
 			delete(l.locks, ip)
+			l.notify("expired", ip, lock)
 		}
 	}
 }
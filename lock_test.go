@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockerExpired(t *testing.T) {
+	store, err := NewLockStore("memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l Locker
+	if err := l.Init(30, store); err != nil {
+		t.Fatal(err)
+	}
+
+	ip := "192.0.2.1"
+	if err := l.Add(ip, "test", ""); err != nil {
+		t.Fatal(err)
+	}
+	expired := l.locks[ip]
+	expired.LockedUntil = time.Now().Add(-time.Minute)
+	l.locks[ip] = expired
+
+	if lock := l.Get(ip); lock.Locked() {
+		t.Errorf("Get returned the expired lock %+v", lock)
+	}
+	if _, err := l.Extend(ip, 10); err != ErrNotLocked {
+		t.Errorf("Extend = %v, want %v", err, ErrNotLocked)
+	}
+	if _, err := l.Confirm(ip, "host.example.com"); err != ErrNotLocked {
+		t.Errorf("Confirm = %v, want %v", err, ErrNotLocked)
+	}
+	if _, err := l.Delete(ip); err != ErrNotLocked {
+		t.Errorf("Delete = %v, want %v", err, ErrNotLocked)
+	}
+	if err := l.Add(ip, "again", ""); err != nil {
+		t.Errorf("Add over the expired lock = %v", err)
+	}
+	if lock := l.Get(ip); lock.Comment != "again" {
+		t.Errorf("Get = %+v, want the new lock", lock)
+	}
+}
@@ -4,11 +4,12 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
@@ -18,11 +19,43 @@ import (
 )
 
 type configuration struct {
-	Port         string `json:"port"`
-	Address      string `json:"address"`
-	Api          string `json:"api"`
-	File         string `json:"file"`
-	LockDuration string `json:"lockDuration"`
+	Port             string `json:"port"`
+	Address          string `json:"address"`
+	Api              string `json:"api"`
+	File             string `json:"file"`
+	ReloadInterval   string `json:"reloadInterval"`
+	LockDuration     string `json:"lockDuration"`
+	LockStore        string `json:"lockStore"`
+	ScanInterval     string `json:"scanInterval"`
+	ScanTimeout      string `json:"scanTimeout"`
+	CheckTimeout     string `json:"checkTimeout"`
+	HistoryStore     string `json:"historyStore"`
+	UpdateServer     string `json:"updateServer"`
+	UpdateKey        string `json:"-"`
+	UpdateTTL        string `json:"updateTTL"`
+	XfrServer        string `json:"xfrServer"`
+	XfrKey           string `json:"-"`
+	DCServers        string `json:"dcServers"`
+	DNSTimeout       string `json:"dnsTimeout"`
+	DNSRetries       string `json:"dnsRetries"`
+	DNSWorkers       string `json:"dnsWorkers"`
+	DNSLookupTimeout string `json:"dnsLookupTimeout"`
+	DNSCacheSize     string `json:"dnsCacheSize"`
+	DNSCacheTTL      string `json:"dnsCacheTTL"`
+	AlertWebhooks    string `json:"-"`
+	AlertHysteresis  string `json:"alertHysteresis"`
+	EventHooks       string `json:"-"`
+	EventSecret      string `json:"-"`
+	EventRetries     string `json:"eventRetries"`
+	EventDeadLetter  string `json:"eventDeadLetter"`
+	AuthTokens       string `json:"-"`
+	AuthHtpasswd     string `json:"authHtpasswd"`
+	AuthLDAP         string `json:"authLDAP"`
+	AuthLDAPDN       string `json:"authLDAPDN"`
+	AuthAdmins       string `json:"authAdmins"`
+	AuthPolicy       string `json:"authPolicy"`
+	AuthDefaultRole  string `json:"authDefaultRole"`
+	CORSOrigins      string `json:"corsOrigins"`
 }
 
 func (c configuration) String() string {
@@ -37,51 +70,265 @@ func init() {
 	env.Var(&config.Address, "ADDR", "0.0.0.0", "Address to bind to")
 	env.Var(&config.Api, "API", "http://127.0.0.1:8080", "Base URL where the API will be reachable. This URL is used be the frontend (/ui) in order to access the backend.")
 	env.Var(&config.File, "FILE", "data/netdef.yaml", "Base directories of the repos")
+	env.Var(&config.ReloadInterval, "RELOAD_INTERVAL", "5", "Interval in seconds in which FILE is checked for changes and reloaded, 0 only reloads it on SIGHUP")
 	env.Var(&config.LockDuration, "LOCK_DURATION", "30", "Duration of a lock in minutes")
+	env.Var(&config.LockStore, "LOCK_STORE", "file:data/locks.db", "Where locks are persisted, either 'memory' or 'file:<path>'")
+	env.Var(&config.HistoryStore, "HISTORY_STORE", "file:data/history.db", "Where the history of IPs is persisted, either 'memory' or 'file:<path>'")
+	env.Var(&config.UpdateServer, "DNS_UPDATE_SERVER", "", "DNS server to which dynamic updates are sent when a reservation is confirmed with a hostname, empty disables updates")
+	env.Var(&config.UpdateKey, "DNS_UPDATE_KEY", "", "TSIG key used to sign dynamic updates, in the form '<algorithm>:<name>:<base64 secret>'")
+	env.Var(&config.UpdateTTL, "DNS_UPDATE_TTL", "3600", "TTL of records created by dynamic updates")
+	env.Var(&config.XfrServer, "DNS_XFR_SERVER", "", "Primary DNS server from which the reverse and forward zones of the networks are transferred, instead of resolving every IP on its own, empty disables transfers")
+	env.Var(&config.XfrKey, "DNS_XFR_KEY", "", "TSIG key used to sign zone transfers, in the form '<algorithm>:<name>:<base64 secret>'")
+	env.Var(&config.DCServers, "DNS_DC_SERVERS", "", "DNS servers used for networks without dns servers of their own, by data center, in the form '<dc>=<server>,<server>;<dc>=<server>'. Networks without any use the resolver of the system.")
+	env.Var(&config.DNSTimeout, "DNS_TIMEOUT", "2", "Timeout of DNS queries in seconds")
+	env.Var(&config.DNSRetries, "DNS_RETRIES", "2", "Number of times the DNS servers of a network are retried if none of them answers")
+	env.Var(&config.ScanInterval, "SCAN_INTERVAL", "10", "Interval in minutes in which all networks are scanned in the background, 0 disables it")
+	env.Var(&config.ScanTimeout, "SCAN_TIMEOUT", "10", "Time in minutes after which the scan of a network is stopped and its results flagged as incomplete")
+	env.Var(&config.CheckTimeout, "CHECK_TIMEOUT", "20", "Time in seconds the checks of IPs during a request may take")
+	env.Var(&config.DNSWorkers, "DNS_WORKERS", "64", "Number of IPs resolved in parallel")
+	env.Var(&config.DNSLookupTimeout, "DNS_LOOKUP_TIMEOUT", "10", "Time in seconds after which resolving a single IP is given up")
+	env.Var(&config.DNSCacheSize, "DNS_CACHE_SIZE", "100000", "Number of DNS responses cached until their TTL expires, 0 disables the cache")
+	env.Var(&config.AlertWebhooks, "ALERT_WEBHOOKS", "", "Webhooks to which alerts are posted when networks reach their thresholds, separated by commas, in the form '[json=|slack=|teams=]<url>'")
+	env.Var(&config.AlertHysteresis, "ALERT_HYSTERESIS", "5", "Percentage points the utilization of a network has to fall below a threshold before its alert is resolved")
+	env.Var(&config.EventHooks, "EVENT_HOOKS", "", "URLs to which events about reservations and IPs are posted, separated by commas, in the form '[<type>|<type>=]<url>', types may end with '*', like 'reservation.*'")
+	env.Var(&config.EventSecret, "EVENT_SECRET", "", "Secret with which events are signed, the HMAC-SHA256 of the body is sent as 'X-Netmgmt-Signature: sha256=<hex>'")
+	env.Var(&config.EventRetries, "EVENT_RETRIES", "5", "Number of times the delivery of an event is retried, with exponential backoff")
+	env.Var(&config.EventDeadLetter, "EVENT_DEAD_LETTER", "data/events-dead.log", "File to which events are appended which could not be delivered, empty disables it")
+	env.Var(&config.AuthTokens, "AUTH_TOKENS", "", "API tokens, sent as 'Authorization: Bearer <token>', separated by commas, in the form '<user>=<token>'. Authentication is disabled without tokens, AUTH_HTPASSWD and AUTH_LDAP.")
+	env.Var(&config.AuthHtpasswd, "AUTH_HTPASSWD", "", "htpasswd file against which users are authenticated with HTTP basic auth. Passwords have to be hashed with {SHA}, $apr1$ or $1$ (htpasswd -m or -s), other entries are skipped with a warning.")
+	env.Var(&config.AuthLDAP, "AUTH_LDAP", "", "Directory against which users are authenticated with HTTP basic auth, in the form 'ldap://<host>[:port]' or 'ldaps://<host>[:port]'")
+	env.Var(&config.AuthLDAPDN, "AUTH_LDAP_DN", "uid=%s,ou=people,dc=example,dc=com", "DN users bind to the directory as, %s is replaced by the user name")
+	env.Var(&config.AuthAdmins, "AUTH_ADMINS", "", "Users who have the role admin on everything, separated by commas")
+	env.Var(&config.AuthPolicy, "AUTH_POLICY", "", "YAML file with groups of users and the roles (viewer, reserver, network-admin, admin) assigned to users and groups, scoped by data center, network or tag")
+	env.Var(&config.AuthDefaultRole, "AUTH_DEFAULT_ROLE", "viewer", "Role every authenticated user has on all networks, 'none' for none. Other roles have to be granted with AUTH_POLICY or AUTH_ADMINS.")
+	env.Var(&config.CORSOrigins, "CORS_ORIGINS", "*", "Origins from which the API may be used by browsers, separated by commas")
+	env.Var(&config.DNSCacheTTL, "DNS_CACHE_TTL", "60", "Time in seconds results of the resolver of the system are cached, as their TTL is unknown")
 }
 
 var locker Locker
+var scanner Scanner
+var history History
+var updater *DNSUpdater
+var transfers *ZoneTransfer
 var networks []*network
 
 func main() {
-	env.Parse("NETMGMT", false)
+	// netmgmt validate [file...] checks the network definitions and exits
+	validate := len(os.Args) > 1 && os.Args[1] == "validate"
+	env.Parse("NETMGMT", validate)
+	if validate {
+		os.Exit(validateCommand(os.Args[2:]))
+	}
 
 	duration, err := strconv.Atoi(config.LockDuration)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	locker.Init(duration)
+	list, err := loadNetworks(config.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+	setNetworks(list)
+
+	if err := history.Init(config.HistoryStore); err != nil {
+		log.Fatal(err)
+	}
+	defer history.Close()
+
+	hooks, err := parseEventHooks(config.EventHooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	events.Secret = config.EventSecret
+	events.DeadLetter = config.EventDeadLetter
+	events.Retries, err = strconv.Atoi(config.EventRetries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	events.Start(hooks)
+
+	locker.Subscribe(history.RecordLock)
+	locker.Subscribe(metrics.RecordLock)
+	locker.Subscribe(events.RecordLock)
+
+	store, err := NewLockStore(config.LockStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := locker.Init(duration, store); err != nil {
+		log.Fatal(err)
+	}
 
-	f, err := os.Open(config.File)
-	defer f.Close()
+	if config.UpdateServer != "" {
+		ttl, err := strconv.Atoi(config.UpdateTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		updater, err = NewDNSUpdater(config.UpdateServer, config.UpdateKey, ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	dnsConfig.DC, err = parseDCServers(config.DCServers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	timeout, err := strconv.Atoi(config.DNSTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnsConfig.Timeout = time.Duration(timeout) * time.Second
+	dnsConfig.Retries, err = strconv.Atoi(config.DNSRetries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnsConfig.Workers, err = strconv.Atoi(config.DNSWorkers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lookupTimeout, err := strconv.Atoi(config.DNSLookupTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
+	dnsConfig.LookupTimeout = time.Duration(lookupTimeout) * time.Second
 
-	b, err := ioutil.ReadAll(f)
+	dnsCache.Size, err = strconv.Atoi(config.DNSCacheSize)
 	if err != nil {
 		log.Fatal(err)
 	}
+	cacheTTL, err := strconv.Atoi(config.DNSCacheTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dnsCache.SystemTTL = time.Duration(cacheTTL) * time.Second
+
+	seconds, err := strconv.Atoi(config.CheckTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	checkTimeout = time.Duration(seconds) * time.Second
+
+	alerts.Webhooks, err = parseWebhooks(config.AlertWebhooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alerts.Hysteresis, err = strconv.Atoi(config.AlertHysteresis)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.XfrServer != "" {
+		transfers, err = NewZoneTransfer(config.XfrServer, config.XfrKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	auth.Tokens, err = parseTokens(config.AuthTokens)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.AuthHtpasswd != "" {
+		h, err := newHtpasswd(config.AuthHtpasswd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth.Authenticators = append(auth.Authenticators, h)
+	}
+	if config.AuthLDAP != "" {
+		l, err := newLDAPAuth(config.AuthLDAP, config.AuthLDAPDN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth.Authenticators = append(auth.Authenticators, l)
+	}
+	auth.Admins = make(map[string]bool)
+	for _, name := range strings.Split(config.AuthAdmins, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			auth.Admins[name] = true
+		}
+	}
+	if config.AuthPolicy != "" {
+		auth.Policy, err = newPolicy(config.AuthPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.AuthDefaultRole != "none" {
+		if roleRank[config.AuthDefaultRole] == 0 {
+			log.Fatalf("unknown default role %q, expected viewer, reserver, network-admin, admin or none", config.AuthDefaultRole)
+		}
+		auth.DefaultRole = config.AuthDefaultRole
+	}
+	if !auth.Enabled() {
+		log.Print("authentication is disabled, set AUTH_TOKENS, AUTH_HTPASSWD or AUTH_LDAP to enable it")
+	}
+
+	interval, err := strconv.Atoi(config.ScanInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scanTimeout, err := strconv.Atoi(config.ScanTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scanner.Init(interval, scanTimeout)
+	scanner.Start()
 
-	networks, err = ReadNetworks(b)
+	reload, err := strconv.Atoi(config.ReloadInterval)
 	if err != nil {
 		log.Fatal(err)
 	}
+	watchNetworks(config.File, time.Duration(reload)*time.Second)
 
 	router := mux.NewRouter()
 	router.HandleFunc("/nodes/{node}", GetNodeInfo).Methods("GET")
 	router.HandleFunc("/networks", GetNetworks).Methods("GET")
 	router.HandleFunc("/networks/{net}", GetNetwork).Methods("GET")
+	router.HandleFunc("/networks/{net}", PostNetwork).Methods("POST")
+	router.HandleFunc("/networks/{net}", PutNetwork).Methods("PUT")
+	router.HandleFunc("/networks/{net}", DeleteNetwork).Methods("DELETE")
+	router.HandleFunc("/networks/{net}/free-subnets", GetFreeSubnets).Methods("GET")
+	router.HandleFunc("/networks/{net}/free-subnets", PostFreeSubnet).Methods("POST")
 	router.HandleFunc("/networks/{net}/ips", GetNetworkIps).Methods("GET")
-	router.HandleFunc("/networks/{net}", PostReservation).Methods("POST")
+	router.HandleFunc("/networks/{net}/scan", GetScan).Methods("GET")
+	router.HandleFunc("/networks/{net}/scan", PostScan).Methods("POST")
+	router.HandleFunc("/networks/{net}/reservations", GetReservations).Methods("GET")
+	router.HandleFunc("/networks/{net}/reservations", PostReservation).Methods("POST")
+	router.HandleFunc("/networks/{net}/reservations/{ip}", DeleteReservation).Methods("DELETE")
+	router.HandleFunc("/networks/{net}/reservations/{ip}", PatchReservation).Methods("PATCH")
+	router.HandleFunc("/networks/{net}/reservations/{ip}/confirm", ConfirmReservation).Methods("POST")
+	router.HandleFunc("/networks/{net}/dns-audit", GetDNSAudit).Methods("GET")
+	router.HandleFunc("/networks/{net}/reclaim", GetNetworkReclaim).Methods("GET")
+	router.HandleFunc("/reclaim", GetReclaim).Methods("GET")
+	router.HandleFunc("/ips/{ip}/history", GetIPHistory).Methods("GET")
+	router.HandleFunc("/dns-cache", GetDNSCache).Methods("GET")
+	router.HandleFunc("/dns-cache", DeleteDNSCache).Methods("DELETE")
+	router.HandleFunc("/stats", GetStats).Methods("GET")
+	router.HandleFunc("/stats/{kind}", GetStats).Methods("GET")
+	router.HandleFunc("/stats/{kind}/{name}", GetStats).Methods("GET")
+	router.HandleFunc("/alerts", GetAlerts).Methods("GET")
+	router.HandleFunc("/alerts/test", PostAlertTest).Methods("POST")
+	router.HandleFunc("/metrics", GetMetrics).Methods("GET")
+	router.HandleFunc("/whoami", GetWhoami).Methods("GET")
 	router.HandleFunc("/conf", GetConfig).Methods("GET")
 	router.HandleFunc("/ui", GetUI).Methods("GET")
 
 	n := negroni.New(
 		negroni.NewRecovery(),
 		logger.NewLogger(),
-		cors.New(cors.Options{AllowedOrigins: []string{"*"}}),
+		cors.New(cors.Options{
+			AllowedOrigins: strings.Split(config.CORSOrigins, ","),
+			AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Accept", "Content-Type", "Authorization"},
+		}),
+		&auth,
 	)
 	n.UseHandler(router)
 
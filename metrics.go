@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics counts what happened since netmgmt was started, for the metrics
+// in the Prometheus exposition format. Gauges are taken from the networks
+// and their latest scans when the metrics are requested.
+type Metrics struct {
+	sync.Mutex
+	scans        map[[2]string]uint64
+	dnsErrors    map[string]uint64
+	pings        map[string]uint64
+	pingReplies  map[string]uint64
+	reservations map[[2]string]uint64
+}
+
+var metrics Metrics
+
+func (m *Metrics) init() {
+	if m.scans == nil {
+		m.scans = make(map[[2]string]uint64)
+		m.dnsErrors = make(map[string]uint64)
+		m.pings = make(map[string]uint64)
+		m.pingReplies = make(map[string]uint64)
+		m.reservations = make(map[[2]string]uint64)
+	}
+}
+
+// RecordScan counts a finished scan.
+func (m *Metrics) RecordScan(sc *scan) {
+	m.Lock()
+	defer m.Unlock()
+	m.init()
+
+	result := "complete"
+	switch {
+	case sc.Error != "":
+		result = "failed"
+	case sc.Incomplete:
+		result = "incomplete"
+	}
+	m.scans[[2]string{sc.Network, result}]++
+	m.dnsErrors[sc.Network] += uint64(sc.DNSErrors)
+	m.pings[sc.Network] += uint64(sc.Pinged)
+	m.pingReplies[sc.Network] += uint64(sc.PingReplies)
+}
+
+// RecordLock counts the changes of reservations by network. It is meant to
+// be subscribed to the Locker.
+func (m *Metrics) RecordLock(e LockEvent) {
+	name := networkOf(net.ParseIP(e.IP))
+
+	m.Lock()
+	defer m.Unlock()
+	m.init()
+
+	m.reservations[[2]string{name, e.Type}]++
+}
+
+// metricWriter writes metrics in the Prometheus exposition format.
+type metricWriter struct {
+	w io.Writer
+}
+
+func (mw metricWriter) header(name string, typ string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes a value of the metric name, with labels given as pairs of
+// names and values.
+func (mw metricWriter) sample(name string, value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(mw.w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// counter writes a counter by network.
+func (mw metricWriter) counter(name string, help string, values map[string]uint64) {
+	mw.header(name, "counter", help)
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		mw.sample(name, float64(values[key]), "network", key)
+	}
+}
+
+// counter2 writes a counter by network and a second label.
+func (mw metricWriter) counter2(name string, help string, label string, values map[[2]string]uint64) {
+	mw.header(name, "counter", help)
+	var keys [][2]string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		mw.sample(name, float64(values[key]), "network", key[0], label, key[1])
+	}
+}
+
+// networkMetrics are the gauges of a network, taken from its latest scan.
+type networkMetrics struct {
+	name        string
+	scanned     bool
+	utilization utilization
+	locked      int
+	sc          *scan
+}
+
+func collectNetworkMetrics() []networkMetrics {
+	var out []networkMetrics
+	for _, n := range getNetworks() {
+		if n.Container {
+			continue
+		}
+		nm := networkMetrics{name: n.Name}
+		if sc := scanner.Get(n.Name); sc != nil && sc.results != nil {
+			c := sc.fresh()
+			for _, r := range c.results {
+				if r.Lock.Locked() {
+					nm.locked++
+				}
+			}
+			nm.scanned = true
+			nm.utilization = c.utilization
+			nm.sc = sc
+		}
+		out = append(out, nm)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].name < out[j].name
+	})
+	return out
+}
+
+// Write writes all metrics to w.
+func (m *Metrics) Write(w io.Writer) {
+	mw := metricWriter{w}
+	networks := collectNetworkMetrics()
+
+	gauge := func(name string, help string, value func(networkMetrics) (float64, bool)) {
+		mw.header(name, "gauge", help)
+		for _, nm := range networks {
+			if v, ok := value(nm); ok {
+				mw.sample(name, v, "network", nm.name)
+			}
+		}
+	}
+	gauge("netmgmt_network_scanned", "Whether the network was scanned since netmgmt was started.", func(nm networkMetrics) (float64, bool) {
+		if nm.scanned {
+			return 1, true
+		}
+		return 0, true
+	})
+	gauge("netmgmt_network_ips_total", "Number of IPs of the network which are checked.", func(nm networkMetrics) (float64, bool) {
+		return float64(nm.utilization.Total), nm.scanned
+	})
+	gauge("netmgmt_network_ips_used", "Number of IPs of the network which are in use.", func(nm networkMetrics) (float64, bool) {
+		return float64(nm.utilization.Used), nm.scanned
+	})
+	gauge("netmgmt_network_ips_free", "Number of IPs of the network which are free.", func(nm networkMetrics) (float64, bool) {
+		return float64(nm.utilization.Free), nm.scanned
+	})
+	gauge("netmgmt_network_ips_locked", "Number of IPs of the network which are reserved.", func(nm networkMetrics) (float64, bool) {
+		return float64(nm.locked), nm.scanned
+	})
+	gauge("netmgmt_scan_timestamp_seconds", "Time the latest scan of the network finished.", func(nm networkMetrics) (float64, bool) {
+		if nm.sc == nil {
+			return 0, false
+		}
+		return float64(nm.sc.Finished.UnixNano()) / 1e9, true
+	})
+	gauge("netmgmt_scan_duration_seconds", "Time the latest scan of the network took.", func(nm networkMetrics) (float64, bool) {
+		if nm.sc == nil {
+			return 0, false
+		}
+		return nm.sc.Finished.Sub(nm.sc.Started).Seconds(), true
+	})
+	gauge("netmgmt_scan_incomplete", "Whether the latest scan of the network did not complete in time.", func(nm networkMetrics) (float64, bool) {
+		if nm.sc == nil {
+			return 0, false
+		}
+		if nm.sc.Incomplete {
+			return 1, true
+		}
+		return 0, true
+	})
+	gauge("netmgmt_scan_dns_errors", "Number of IPs which could not be resolved in the latest scan of the network.", func(nm networkMetrics) (float64, bool) {
+		if nm.sc == nil {
+			return 0, false
+		}
+		return float64(nm.sc.DNSErrors), true
+	})
+	gauge("netmgmt_scan_ping_loss_ratio", "Share of the pinged IPs which did not answer in the latest scan of the network.", func(nm networkMetrics) (float64, bool) {
+		if nm.sc == nil || nm.sc.Pinged == 0 {
+			return 0, false
+		}
+		return 1 - float64(nm.sc.PingReplies)/float64(nm.sc.Pinged), true
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	m.init()
+
+	mw.counter2("netmgmt_scans_total", "Number of scans by network and result (complete, incomplete or failed).", "result", m.scans)
+	mw.counter("netmgmt_dns_errors_total", "Number of IPs which could not be resolved during scans.", m.dnsErrors)
+	mw.counter("netmgmt_pings_total", "Number of IPs pinged during scans.", m.pings)
+	mw.counter("netmgmt_ping_replies_total", "Number of pinged IPs which answered during scans.", m.pingReplies)
+	mw.counter2("netmgmt_reservations_total", "Number of changes of reservations by network and event (created, released, extended, confirmed or expired).", "event", m.reservations)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	useScanner(t)
+	useLocker(t, "192.0.2.2")
+	saved := getNetworks()
+	t.Cleanup(func() { setNetworks(saved) })
+	setNetworks([]*network{
+		{Name: "b", CIDR: "198.51.100.0/24"},
+		{Name: "a", CIDR: "192.0.2.0/24"},
+		{Name: "all", CIDR: "192.0.0.0/16", Container: true},
+	})
+
+	started := time.Unix(1700000000, 0)
+	sc := &scan{
+		Network:     "a",
+		Started:     started,
+		Finished:    started.Add(1500 * time.Millisecond),
+		DNSErrors:   1,
+		Pinged:      4,
+		PingReplies: 1,
+		results: map[string]*ResultSet{
+			"192.0.2.1": {IP: net.ParseIP("192.0.2.1"), Pingable: true},
+			"192.0.2.2": {IP: net.ParseIP("192.0.2.2")},
+			"192.0.2.3": {IP: net.ParseIP("192.0.2.3")},
+			"192.0.2.4": {IP: net.ParseIP("192.0.2.4")},
+		},
+	}
+	scanner.scans["a"] = sc
+
+	var m Metrics
+	m.RecordScan(sc)
+	m.RecordScan(&scan{Network: "a", Incomplete: true})
+	m.RecordScan(&scan{Network: "b", Error: "invalid CIDR"})
+	m.RecordLock(LockEvent{Type: "created", IP: "192.0.2.2"})
+	m.RecordLock(LockEvent{Type: "created", IP: "192.0.2.3"})
+	m.RecordLock(LockEvent{Type: "released", IP: "192.0.2.3"})
+	m.RecordLock(LockEvent{Type: "created", IP: "203.0.113.1"})
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		"# HELP netmgmt_network_scanned Whether the network was scanned since netmgmt was started.\n# TYPE netmgmt_network_scanned gauge\n" +
+			"netmgmt_network_scanned{network=\"a\"} 1\nnetmgmt_network_scanned{network=\"b\"} 0\n",
+		"# TYPE netmgmt_network_ips_total gauge\nnetmgmt_network_ips_total{network=\"a\"} 4\n#",
+		"netmgmt_network_ips_used{network=\"a\"} 2\n",
+		"netmgmt_network_ips_free{network=\"a\"} 2\n",
+		"netmgmt_network_ips_locked{network=\"a\"} 1\n",
+		"netmgmt_scan_timestamp_seconds{network=\"a\"} 1.7000000015e+09\n",
+		"netmgmt_scan_duration_seconds{network=\"a\"} 1.5\n",
+		"netmgmt_scan_incomplete{network=\"a\"} 0\n",
+		"netmgmt_scan_dns_errors{network=\"a\"} 1\n",
+		"netmgmt_scan_ping_loss_ratio{network=\"a\"} 0.75\n",
+		"# TYPE netmgmt_scans_total counter\n" +
+			"netmgmt_scans_total{network=\"a\",result=\"complete\"} 1\n" +
+			"netmgmt_scans_total{network=\"a\",result=\"incomplete\"} 1\n" +
+			"netmgmt_scans_total{network=\"b\",result=\"failed\"} 1\n",
+		"netmgmt_pings_total{network=\"a\"} 4\n",
+		"netmgmt_ping_replies_total{network=\"a\"} 1\n",
+		// reservations outside of any network are counted without one
+		"# TYPE netmgmt_reservations_total counter\n" +
+			"netmgmt_reservations_total{network=\"\",event=\"created\"} 1\n" +
+			"netmgmt_reservations_total{network=\"a\",event=\"created\"} 2\n" +
+			"netmgmt_reservations_total{network=\"a\",event=\"released\"} 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics lack\n%s\ngot\n%s", want, out)
+		}
+	}
+	// containers are not scanned, and networks which were not have no
+	// values of scans
+	for _, unwanted := range []string{`network="all"`, `netmgmt_network_ips_total{network="b"}`, `netmgmt_scan_duration_seconds{network="b"}`} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("metrics contain %s:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestMetricLabelEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	metricWriter{&buf}.sample("test", 1, "network", "a\"b\\c\nd")
+	if got, want := buf.String(), `test{network="a\"b\\c\nd"} 1`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// netdefMu serializes changes of the network definitions.
+var netdefMu sync.Mutex
+
+var (
+	ErrNetworkExists  = errors.New("network already exists")
+	ErrNetworkMissing = errors.New("network does not exist")
+)
+
+// runtimeFields are fields of a network which are computed by netmgmt and
+// never written to the definitions.
+var runtimeFields = map[string]bool{
+	"utilization": true,
+}
+
+// readDefinitions reads the network definitions as ordered maps, so that
+// they can be written back with fields unknown to netmgmt and in their
+// original order.
+func readDefinitions(path string) ([]yaml.MapSlice, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var defs []yaml.MapSlice
+	if err := yaml.Unmarshal(b, &defs); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// writeDefinitions replaces the file at path with defs. The file is
+// written next to it and renamed, so that it is never left half written.
+func writeDefinitions(path string, defs []yaml.MapSlice) error {
+	b, err := yaml.Marshal(defs)
+	if err != nil {
+		return err
+	}
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+	}
+
+	dir, name := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func definitionName(def yaml.MapSlice) string {
+	for _, item := range def {
+		if item.Key == "name" {
+			name, _ := item.Value.(string)
+			return name
+		}
+	}
+	return ""
+}
+
+// isZero reports whether a value decoded from YAML is empty.
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case int:
+		return v == 0
+	case float64:
+		return v == 0
+	case []interface{}:
+		return len(v) == 0
+	case yaml.MapSlice:
+		for _, item := range v {
+			if !isZero(item.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// mergeFields updates the fields of def with the ones of fields. Fields
+// which are not part of fields are kept, fields which are empty in fields
+// are removed, new ones are appended and nested maps are merged the same
+// way.
+func mergeFields(def yaml.MapSlice, fields yaml.MapSlice) yaml.MapSlice {
+	out := append(yaml.MapSlice{}, def...)
+	for _, field := range fields {
+		i := -1
+		for j, item := range out {
+			if item.Key == field.Key {
+				i = j
+				break
+			}
+		}
+
+		switch {
+		case isZero(field.Value):
+			if i >= 0 {
+				out = append(out[:i], out[i+1:]...)
+			}
+		case i < 0:
+			out = append(out, field)
+		default:
+			old, ok1 := out[i].Value.(yaml.MapSlice)
+			updated, ok2 := field.Value.(yaml.MapSlice)
+			if ok1 && ok2 {
+				out[i].Value = mergeFields(old, updated)
+			} else {
+				out[i].Value = field.Value
+			}
+		}
+	}
+	return out
+}
+
+// mergeDefinition updates def, which may be empty, with the definition of
+// n.
+func mergeDefinition(def yaml.MapSlice, n *network) (yaml.MapSlice, error) {
+	b, err := yaml.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	var fields yaml.MapSlice
+	if err := yaml.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	known := fields[:0]
+	for _, field := range fields {
+		if key, _ := field.Key.(string); !runtimeFields[key] {
+			known = append(known, field)
+		}
+	}
+	return mergeFields(def, known), nil
+}
+
+// saveNetwork writes the definition of n to the file at path, replacing the
+// network of the same name if replace is set or adding it otherwise.
+func saveNetwork(path string, n *network, replace bool) error {
+	defs, err := readDefinitions(path)
+	if err != nil {
+		return err
+	}
+
+	i := -1
+	for j, def := range defs {
+		if definitionName(def) == n.Name {
+			i = j
+		}
+	}
+	switch {
+	case replace && i < 0:
+		return ErrNetworkMissing
+	case !replace && i >= 0:
+		return ErrNetworkExists
+	}
+
+	if i < 0 {
+		def, err := mergeDefinition(nil, n)
+		if err != nil {
+			return err
+		}
+		defs = append(defs, def)
+	} else {
+		if defs[i], err = mergeDefinition(defs[i], n); err != nil {
+			return err
+		}
+	}
+	return writeDefinitions(path, defs)
+}
+
+// deleteNetwork removes the definition of the network name from the file
+// at path.
+func deleteNetwork(path string, name string) error {
+	defs, err := readDefinitions(path)
+	if err != nil {
+		return err
+	}
+	for i, def := range defs {
+		if definitionName(def) == name {
+			return writeDefinitions(path, append(defs[:i], defs[i+1:]...))
+		}
+	}
+	return ErrNetworkMissing
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const testNetdef = `- name: first
+  owner: team-a
+  cidr: 192.0.2.0/24
+  vlan:
+    name: servers
+    id: 10
+    note: rack 4
+  dhcp:
+    - start: 192.0.2.100
+      end: 192.0.2.150
+- name: second
+  cidr: 198.51.100.0/24
+`
+
+// writeNetdef writes testNetdef to a file reached through a symlink, as
+// definitions are often deployed, and returns the path of the symlink.
+func writeNetdef(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	target := filepath.Join(dir, "netdef.yaml.real")
+	if err := ioutil.WriteFile(target, []byte(testNetdef), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "netdef.yaml")
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readNetdef(t *testing.T, path string) ([]yaml.MapSlice, []*network) {
+	t.Helper()
+	defs, err := readDefinitions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks, err := ReadNetworks(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return defs, networks
+}
+
+func keys(def yaml.MapSlice) []interface{} {
+	out := []interface{}{}
+	for _, item := range def {
+		out = append(out, item.Key)
+	}
+	return out
+}
+
+func TestSaveNetworkReplace(t *testing.T) {
+	path := writeNetdef(t)
+	_, networks := readNetdef(t, path)
+
+	n := *networks[0]
+	n.Description = "web servers"
+	n.Vlan.Id = 11
+	n.DHCP = nil
+	n.Utilization = utilization{Total: 254}
+	if err := saveNetwork(path, &n, true); err != nil {
+		t.Fatal(err)
+	}
+
+	defs, networks := readNetdef(t, path)
+	if len(defs) != 2 {
+		t.Fatalf("got %d definitions, want 2", len(defs))
+	}
+	// unknown fields and the order are kept, emptied fields are removed
+	// and new ones appended
+	want := []interface{}{"name", "owner", "cidr", "vlan", "description"}
+	if got := keys(defs[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("fields = %v, want %v", got, want)
+	}
+	vlan, _ := defs[0][3].Value.(yaml.MapSlice)
+	if got := keys(vlan); !reflect.DeepEqual(got, []interface{}{"name", "id", "note"}) {
+		t.Errorf("fields of the VLAN = %v", got)
+	}
+	if got := networks[0]; got.Description != "web servers" || got.Vlan.Id != 11 || got.Vlan.Name != "servers" || len(got.DHCP) != 0 {
+		t.Errorf("network = %+v", got)
+	}
+	if got := keys(defs[1]); !reflect.DeepEqual(got, []interface{}{"name", "cidr"}) {
+		t.Errorf("other network was changed: %v", defs[1])
+	}
+
+	// the file behind the symlink is replaced with its mode
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("the symlink was replaced: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode())
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".netdef*")); len(matches) != 0 {
+		t.Errorf("temporary files were left behind: %v", matches)
+	}
+}
+
+func TestSaveNetworkAddAndDelete(t *testing.T) {
+	path := writeNetdef(t)
+
+	n := &network{Name: "third", CIDR: "203.0.113.0/24", DC: "dc1", Tags: []string{"db"}}
+	if err := saveNetwork(path, n, false); err != nil {
+		t.Fatal(err)
+	}
+	defs, networks := readNetdef(t, path)
+	if len(networks) != 3 || networks[2].Name != "third" || networks[2].DC != "dc1" {
+		t.Fatalf("networks = %v", networks)
+	}
+	if got := keys(defs[2]); !reflect.DeepEqual(got, []interface{}{"name", "cidr", "dc", "tags"}) {
+		t.Errorf("fields of the new network = %v", got)
+	}
+
+	if err := saveNetwork(path, n, false); err != ErrNetworkExists {
+		t.Errorf("adding it again = %v, want %v", err, ErrNetworkExists)
+	}
+	if err := saveNetwork(path, &network{Name: "fourth"}, true); err != ErrNetworkMissing {
+		t.Errorf("replacing a missing network = %v, want %v", err, ErrNetworkMissing)
+	}
+
+	if err := deleteNetwork(path, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, networks := readNetdef(t, path); len(networks) != 2 || networks[0].Name != "second" || networks[1].Name != "third" {
+		t.Errorf("networks after deleting first = %v", networks)
+	}
+	if err := deleteNetwork(path, "first"); err != ErrNetworkMissing {
+		t.Errorf("deleting it again = %v, want %v", err, ErrNetworkMissing)
+	}
+}
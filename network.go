@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -18,17 +21,47 @@ func ReadNetworks(data []byte) ([]*network, error) {
 	return networks, nil
 }
 
+func findNetwork(name string) *network {
+	for _, n := range getNetworks() {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// networkOf returns the name of the network ip is part of, leaving out
+// containers, or an empty string if there is none.
+func networkOf(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	for _, n := range getNetworks() {
+		if !n.Container && n.Contains(ip) {
+			return n.Name
+		}
+	}
+	return ""
+}
+
 type network struct {
 	Name          string         `yaml:"name" json:"name"`
 	Description   string         `yaml:"description" json:"description"`
 	CIDR          string         `yaml:"cidr" json:"cidr"`
+	Container     bool           `yaml:"container" json:"container"`
+	Parent        string         `yaml:"parent" json:"parent"`
 	DC            string         `yaml:"dc" json:"dc"`
+	Tags          []string       `yaml:"tags" json:"tags"`
+	Domain        string         `yaml:"domain" json:"domain"`
 	Managed       bool           `yaml:"managed" json:"managed"`
 	Gateway       net.IP         `yaml:"gateway" json:"gateway"`
 	DNS           []net.IP       `yaml:"dns" json:"dns"`
 	Vlan          vlan           `yaml:"vlan" json:"vlan"`
 	DHCP          []rng          `yaml:"dhcp" json:"dhcp"`
 	ForeignRanges []foreignRange `yaml:"foreign_ranges" json:"foreign_ranges"`
+	Allocation    allocation     `yaml:"allocation" json:"allocation"`
+	SLAAC         bool           `yaml:"slaac" json:"slaac"`
+	Thresholds    thresholds     `yaml:"thresholds" json:"thresholds"`
 	Utilization   utilization    `yaml:"utilization" json:"utilization"`
 }
 
@@ -48,8 +81,216 @@ func (n network) Contains(ip net.IP) bool {
 	return ipnet.Contains(ip)
 }
 
+// problem is an inconsistency in the definition of a network. Field is the
+// path of the field it was found at, like "dhcp.0", so that it can be
+// located in the definitions.
+type problem struct {
+	Field   string
+	Message string
+}
+
+// problems checks that the definition of the network is consistent.
+func (n network) problems() []problem {
+	var out []problem
+	add := func(field string, format string, args ...interface{}) {
+		out = append(out, problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n.Name == "" || strings.ContainsAny(n.Name, "/ \t") {
+		add("name", "invalid network name %q", n.Name)
+	}
+	ip, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		add("cidr", "network %s: invalid cidr %q", n.Name, n.CIDR)
+		return out
+	}
+	if !ip.Equal(ipnet.IP) {
+		add("cidr", "network %s: %s is not the address of the network, it would be %v", n.Name, n.CIDR, ipnet)
+	}
+	if n.Gateway != nil && !ipnet.Contains(n.Gateway) {
+		add("gateway", "network %s: gateway %v is not part of the network", n.Name, n.Gateway)
+	}
+	for i, r := range n.DHCP {
+		if err := r.validate(ipnet); err != nil {
+			add(fmt.Sprintf("dhcp.%d", i), "network %s: dhcp range %v", n.Name, err)
+		}
+	}
+	for i, f := range n.ForeignRanges {
+		if err := f.Rng.validate(ipnet); err != nil {
+			add(fmt.Sprintf("foreign_ranges.%d", i), "network %s: foreign range %v", n.Name, err)
+		}
+	}
+	if _, err := NewAllocator(n.Allocation.Strategy, n.Allocation.Offset); err != nil {
+		add("allocation", "network %s: %v", n.Name, err)
+	}
+	if err := n.Thresholds.validate(); err != nil {
+		add("thresholds", "network %s: %v", n.Name, err)
+	}
+	return out
+}
+
+// Validate checks that the definition of the network is consistent and
+// returns the first problem found.
+func (n network) Validate() error {
+	if p := n.problems(); len(p) > 0 {
+		return errors.New(p[0].Message)
+	}
+	return nil
+}
+
+// Overlaps reports whether two networks share addresses.
+func (n network) Overlaps(o network) bool {
+	_, a, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return false
+	}
+	_, b, err := net.ParseCIDR(o.CIDR)
+	if err != nil {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Encloses reports whether n is a container holding all addresses of o.
+func (n network) Encloses(o network) bool {
+	if !n.Container {
+		return false
+	}
+	_, a, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return false
+	}
+	_, b, err := net.ParseCIDR(o.CIDR)
+	if err != nil {
+		return false
+	}
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	return aBits == bBits && aOnes <= bOnes && a.Contains(b.IP)
+}
+
+// Conflicts reports whether two networks share addresses without one of
+// them being a container of the other.
+func (n network) Conflicts(o network) bool {
+	return n.Overlaps(o) && !n.Encloses(o) && !o.Encloses(n)
+}
+
+// checkParent checks that the parent of n, if it has one, is a container
+// in list which holds n.
+func (n network) checkParent(list []*network) error {
+	if n.Parent == "" {
+		return nil
+	}
+	for _, p := range list {
+		if p == nil || p.Name != n.Parent {
+			continue
+		}
+		if p.Name == n.Name || !p.Container {
+			return fmt.Errorf("network %s: parent %s is not a container", n.Name, n.Parent)
+		}
+		if !p.Encloses(n) {
+			return fmt.Errorf("network %s: %s is not part of its parent %s %s", n.Name, n.CIDR, p.Name, p.CIDR)
+		}
+		return nil
+	}
+	return fmt.Errorf("network %s: parent %s does not exist", n.Name, n.Parent)
+}
+
+// Lookup returns how the IPs of the network are resolved: with its own DNS
+// servers, the ones of its data center, or the resolver of the system if
+// there are none.
+func (n network) Lookup() dnsLookup {
+	var servers []string
+	for _, ip := range n.DNS {
+		servers = append(servers, withPort(ip.String()))
+	}
+	if len(servers) == 0 {
+		servers = dnsConfig.DC[n.DC]
+	}
+	if len(servers) == 0 {
+		return systemDNS{}
+	}
+	return &dnsClient{
+		Servers: servers,
+		Timeout: dnsConfig.Timeout,
+		Retries: dnsConfig.Retries,
+	}
+}
+
+// maxExpand is the number of addresses up to which a network is expanded
+// completely. Larger networks, like an IPv6 /64, only keep track of the
+// addresses known to be in use.
+const maxExpand = 1 << 16
+
+// Sparse reports whether the network is too large to be expanded.
+func (n network) Sparse() bool {
+	_, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return false
+	}
+	ones, bits := ipnet.Mask.Size()
+	return bits-ones > 16
+}
+
+// Bits returns the length of the addresses of the network in bits.
+func (n network) Bits() int {
+	_, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return 0
+	}
+	_, bits := ipnet.Mask.Size()
+	return bits
+}
+
+// Hosts returns the first and the last host address of the network. For
+// IPv4 the network and broadcast addresses are left out, for IPv6 the
+// subnet-router anycast address and the reserved subnet anycast addresses.
+func (n network) Hosts() (net.IP, net.IP, error) {
+	_, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	first := dupIP(ipnet.IP)
+	last := dupIP(ipnet.IP)
+	mask := ipnet.Mask[len(ipnet.Mask)-len(last):]
+	for i := range last {
+		last[i] |= ^mask[i]
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		return first, last, nil
+	}
+	first = nextIP(first)
+	if first.To4() != nil {
+		last = prevIP(last)
+	} else if bits-ones >= 64 {
+		// the highest 128 addresses are reserved anycast addresses (RFC 2526)
+		last[len(last)-1] &^= 0x80
+	}
+	return first, last, nil
+}
+
+// Walk calls fn for every host address of the network in ascending order,
+// until fn returns false.
+func (n network) Walk(fn func(net.IP) bool) error {
+	first, last, err := n.Hosts()
+	if err != nil {
+		return err
+	}
+	for ip := first; ; ip = nextIP(ip) {
+		if !fn(ip) || ip.Equal(last) {
+			return nil
+		}
+	}
+}
+
 func (n network) Expand() ([]net.IP, error) {
 	out := []net.IP{}
+	if n.Sparse() {
+		return out, fmt.Errorf("network %s is too large to be expanded", n.CIDR)
+	}
 	ip, ipnet, err := net.ParseCIDR(n.CIDR)
 	if err != nil {
 		return out, err
@@ -62,6 +303,23 @@ func (n network) Expand() ([]net.IP, error) {
 	return out, nil
 }
 
+// Known returns the addresses of the network known to be in use: its
+// gateway, DNS servers and reserved IPs. For sparse networks these are the
+// only addresses which are checked.
+func (n network) Known() []net.IP {
+	out := []net.IP{}
+	candidates := append([]net.IP{n.Gateway}, n.DNS...)
+	for ip := range locker.List() {
+		candidates = append(candidates, net.ParseIP(ip))
+	}
+	for _, ip := range candidates {
+		if ip != nil && n.Contains(ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
 type detailedIP map[string]details
 
 type details struct {
@@ -69,66 +327,86 @@ type details struct {
 	Unmanaged string `json:"unmanaged"`
 }
 
-func (n network) ExpandDetailed() (detailedIP, error) {
-	out := detailedIP{}
-
-	all, err := n.Expand()
-	if err != nil {
-		return out, err
-	}
-
-	// assume that last ip is broadcast an first is network
-	l := len(all) - 1
-	all = all[1:l]
-
-	for _, ip := range all {
-		out[ip.String()] = details{IP: ip}
-	}
-
-	for _, dr := range n.DHCP {
-		for _, ip := range dr.Expand() {
-			out[ip.String()] = details{IP: ip, Unmanaged: "DHCP"}
+// each calls fn with the details of every host address of a network, or of
+// every known address if the network is sparse.
+func (n network) each(fn func(details)) error {
+	if n.Sparse() {
+		for _, ip := range n.Known() {
+			if d, ok := n.Details(ip); ok {
+				fn(d)
+			}
 		}
+		return nil
 	}
-
-	for _, fr := range n.ForeignRanges {
-		for _, ip := range fr.Rng.Expand() {
-			out[ip.String()] = details{IP: ip, Unmanaged: "Foreign Range: " + fr.Description}
+	return n.Walk(func(ip net.IP) bool {
+		if d, ok := n.Details(ip); ok {
+			fn(d)
 		}
-	}
+		return true
+	})
+}
 
-	return out, nil
+func (n network) ExpandDetailed() (detailedIP, error) {
+	out := detailedIP{}
+	err := n.each(func(d details) {
+		out[d.IP.String()] = d
+	})
+	return out, err
 }
 
 func (n network) ExpandManaged() (detailedIP, error) {
 	out := detailedIP{}
+	err := n.each(func(d details) {
+		if d.Unmanaged == "" {
+			out[d.IP.String()] = d
+		}
+	})
+	return out, err
+}
 
-	all, err := n.Expand()
-	if err != nil {
-		return out, err
+// Details describes a single host address of the network. It returns false
+// if ip is not one of the host addresses of the network.
+func (n network) Details(ip net.IP) (details, bool) {
+	first, last, err := n.Hosts()
+	if err != nil || compareIP(ip, first) < 0 || compareIP(ip, last) > 0 {
+		return details{}, false
 	}
-
-	// assume that last ip is broadcast an first is network
-	l := len(all) - 1
-	all = all[1:l]
-
-	for _, ip := range all {
-		out[ip.String()] = details{IP: ip}
+	if (ip.To4() == nil) != (first.To4() == nil) {
+		return details{}, false
 	}
 
+	d := details{IP: dupIP(ip)}
+	if n.SLAAC && isEUI64(ip) {
+		d.Unmanaged = "SLAAC"
+	}
 	for _, dr := range n.DHCP {
-		for _, ip := range dr.Expand() {
-			delete(out, ip.String()) //out[ip.String()] = details{Unmanaged: "DHCP"}
+		if dr.Contains(ip) {
+			d.Unmanaged = "DHCP"
 		}
 	}
-
 	for _, fr := range n.ForeignRanges {
-		for _, ip := range fr.Rng.Expand() {
-			delete(out, ip.String()) //out[ip.String()] = details{Unmanaged: fr.Description}
+		if fr.Rng.Contains(ip) {
+			d.Unmanaged = "Foreign Range: " + fr.Description
 		}
 	}
+	return d, true
+}
 
-	return out, nil
+// isEUI64 reports whether ip is an IPv6 address with an interface ID
+// derived from a MAC address, as used by SLAAC.
+func isEUI64(ip net.IP) bool {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return false
+	}
+	return ip[11] == 0xff && ip[12] == 0xfe
+}
+
+// eui64MAC returns the MAC address an EUI-64 interface ID was derived from.
+func eui64MAC(ip net.IP) net.HardwareAddr {
+	if !isEUI64(ip) {
+		return nil
+	}
+	return net.HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
 }
 
 type rng struct {
@@ -136,11 +414,27 @@ type rng struct {
 	End   net.IP `yaml:"end" json:"end"`
 }
 
+func (r rng) validate(ipnet *net.IPNet) error {
+	if r.Start == nil || r.End == nil {
+		return fmt.Errorf("%v-%v needs a start and an end", r.Start, r.End)
+	}
+	if !ipnet.Contains(r.Start) || !ipnet.Contains(r.End) {
+		return fmt.Errorf("%v-%v is not part of %v", r.Start, r.End, ipnet)
+	}
+	if compareIP(r.Start, r.End) > 0 {
+		return fmt.Errorf("%v-%v starts after its end", r.Start, r.End)
+	}
+	return nil
+}
+
 func (r rng) Expand() []net.IP {
+	if r.Start == nil || r.End == nil || compareIP(r.Start, r.End) > 0 {
+		return []net.IP{}
+	}
 	ip := dupIP(r.Start)
 	out := []net.IP{ip}
 
-	for !ip.Equal(r.End) {
+	for compareIP(ip, r.End) < 0 {
 		ip = nextIP(ip)
 		out = append(out, ip)
 	}
@@ -148,6 +442,16 @@ func (r rng) Expand() []net.IP {
 	return out
 }
 
+func (r rng) Contains(ip net.IP) bool {
+	return compareIP(r.Start, ip) <= 0 && compareIP(ip, r.End) <= 0
+}
+
+// compareIP orders IPs of the same family, comparing IPv4 addresses in
+// their 16 byte form.
+func compareIP(a, b net.IP) int {
+	return bytes.Compare(a.To16(), b.To16())
+}
+
 func dupIP(ip net.IP) net.IP {
 	// To save space, try and only use 4 bytes
 	if x := ip.To4(); x != nil {
@@ -158,6 +462,37 @@ func dupIP(ip net.IP) net.IP {
 	return dup
 }
 
+func prevIP(ip net.IP) net.IP {
+	prev := dupIP(ip)
+	for j := len(prev) - 1; j >= 0; j-- {
+		prev[j]--
+		if prev[j] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// ipToInt and intToIP convert between IPs and integers, so that offsets
+// can be calculated in networks of any size.
+func ipToInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(dupIP(ip))
+}
+
+func intToIP(i *big.Int, v4 bool) net.IP {
+	size := net.IPv6len
+	if v4 {
+		size = net.IPv4len
+	}
+	b := i.Bytes()
+	if len(b) > size {
+		b = b[len(b)-size:]
+	}
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
 func nextIP(ip net.IP) net.IP {
 	next := dupIP(ip)
 	for j := len(next) - 1; j >= 0; j-- {
@@ -190,7 +525,15 @@ func tokenizeIP(ip net.IP) ([]uint, error) {
 			nil
 	}
 
-	msg := fmt.Sprintf("%v is not an IPv4 address", ip)
+	if p6 := p.To16(); len(p6) == net.IPv6len {
+		tokens := make([]uint, net.IPv6len)
+		for i, b := range p6 {
+			tokens[i] = uint(b)
+		}
+		return tokens, nil
+	}
+
+	msg := fmt.Sprintf("%v is not an IP address", ip)
 	var tokens []uint
 	return tokens, errors.New(msg)
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNetworkDetails(t *testing.T) {
+	n := network{
+		Name: "test",
+		CIDR: "192.0.2.0/24",
+		DHCP: []rng{{Start: net.ParseIP("192.0.2.100"), End: net.ParseIP("192.0.2.149")}},
+		ForeignRanges: []foreignRange{
+			{Description: "lab", Rng: rng{Start: net.ParseIP("192.0.2.200"), End: net.ParseIP("192.0.2.209")}},
+		},
+	}
+	tests := []struct {
+		ip        string
+		ok        bool
+		unmanaged string
+	}{
+		{"192.0.2.1", true, ""},
+		{"192.0.2.99", true, ""},
+		{"192.0.2.100", true, "DHCP"},
+		{"192.0.2.149", true, "DHCP"},
+		{"192.0.2.150", true, ""},
+		{"192.0.2.205", true, "Foreign Range: lab"},
+		{"192.0.2.254", true, ""},
+		// network and broadcast address
+		{"192.0.2.0", false, ""},
+		{"192.0.2.255", false, ""},
+		{"192.0.3.1", false, ""},
+		{"2001:db8::1", false, ""},
+	}
+	for _, tt := range tests {
+		d, ok := n.Details(net.ParseIP(tt.ip))
+		if ok != tt.ok || d.Unmanaged != tt.unmanaged {
+			t.Errorf("Details(%s) = %+v, %v, want unmanaged %q, %v", tt.ip, d, ok, tt.unmanaged, tt.ok)
+		}
+		if ok && d.IP.String() != tt.ip {
+			t.Errorf("Details(%s).IP = %v", tt.ip, d.IP)
+		}
+	}
+}
+
+func TestResultSetConflict(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name string
+		rs   ResultSet
+		want string
+	}{
+		{"free", ResultSet{IP: ip}, ""},
+		{"unmanaged", ResultSet{IP: ip, Unmanaged: "DHCP", Pingable: true}, "192.0.2.1 is not managed: DHCP"},
+		{"reserved", ResultSet{IP: ip, Lock: Lock{Comment: "web"}, Pingable: true}, "192.0.2.1 is already reserved"},
+		{"pingable", ResultSet{IP: ip, Pingable: true, Name: "host."}, "192.0.2.1 answers to ping"},
+		{"PTR", ResultSet{IP: ip, Name: "host."}, "192.0.2.1 has a PTR record pointing to host."},
+	}
+	for _, tt := range tests {
+		if got := tt.rs.Conflict(); got != tt.want {
+			t.Errorf("%s: Conflict() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHosts(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		first, last string
+	}{
+		{"192.0.2.0/24", "192.0.2.1", "192.0.2.254"},
+		{"192.0.2.0/30", "192.0.2.1", "192.0.2.2"},
+		// point-to-point links and single hosts have no network and
+		// broadcast address
+		{"192.0.2.0/31", "192.0.2.0", "192.0.2.1"},
+		{"192.0.2.7/32", "192.0.2.7", "192.0.2.7"},
+		// the anycast addresses of RFC 2526 are only reserved in subnets
+		// with 64 bits of interface identifier
+		{"2001:db8::/64", "2001:db8::1", "2001:db8::ffff:ffff:ffff:ff7f"},
+		{"2001:db8::/56", "2001:db8::1", "2001:db8:0:ff:ffff:ffff:ffff:ff7f"},
+		{"2001:db8::/120", "2001:db8::1", "2001:db8::ff"},
+		{"2001:db8::/127", "2001:db8::", "2001:db8::1"},
+		{"2001:db8::1/128", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		first, last, err := network{CIDR: tt.cidr}.Hosts()
+		if err != nil {
+			t.Errorf("%s: %v", tt.cidr, err)
+			continue
+		}
+		if first.String() != tt.first || last.String() != tt.last {
+			t.Errorf("Hosts(%s) = %v - %v, want %s - %s", tt.cidr, first, last, tt.first, tt.last)
+		}
+	}
+	if _, _, err := (network{CIDR: "192.0.2.0"}).Hosts(); err == nil {
+		t.Error("Hosts of an invalid CIDR succeeded")
+	}
+}
+
+// useLocker replaces the locks of the global locker with ips for the
+// duration of a test.
+func useLocker(t *testing.T, ips ...string) {
+	t.Helper()
+	reset := func() {
+		store, err := NewLockStore("memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := locker.Init(30, store); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+	for _, ip := range ips {
+		if err := locker.Add(ip, "test", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKnown(t *testing.T) {
+	useLocker(t, "2001:db8::10", "2001:db8:1::10", "192.0.2.10")
+	n := network{
+		CIDR:    "2001:db8::/64",
+		Gateway: net.ParseIP("2001:db8::1"),
+		DNS:     parseIPs("2001:db8::53", "2001:db8:ffff::53"),
+	}
+	if !n.Sparse() {
+		t.Fatalf("%s is not sparse", n.CIDR)
+	}
+	got := ipStrings(n.Known())
+	sort.Strings(got)
+	want := []string{"2001:db8::1", "2001:db8::10", "2001:db8::53"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Known() = %v, want %v", got, want)
+	}
+
+	var each []string
+	if err := n.each(func(d details) { each = append(each, d.IP.String()) }); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(each)
+	if !reflect.DeepEqual(each, want) {
+		t.Errorf("each visited %v, want %v", each, want)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	useLocker(t, "2001:db8::3")
+	n := &network{
+		CIDR:    "2001:db8::/64",
+		Gateway: net.ParseIP("2001:db8::1"),
+	}
+	lowest, err := NewAllocator("lowest", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	highest, err := NewAllocator("highest", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		a      Allocator
+		size   int
+		prefix int
+		want   int
+		ips    []string
+	}{
+		{"single", lowest, 1, 0, 3, []string{"2001:db8::2", "2001:db8::4", "2001:db8::5"}},
+		{"highest", highest, 1, 0, 2, []string{"2001:db8::ffff:ffff:ffff:ff7e", "2001:db8::ffff:ffff:ffff:ff7f"}},
+		// ::2 and ::3 don't make a block, as ::3 is reserved
+		{"block", lowest, 2, 0, 1, []string{"2001:db8::4", "2001:db8::5"}},
+		{"aligned", lowest, 4, 124, 1, []string{"2001:db8::10", "2001:db8::11", "2001:db8::12", "2001:db8::13"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for ip := range Candidates(n, tt.a, tt.size, tt.prefix, tt.want) {
+			got = append(got, ip)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.ips) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.ips)
+		}
+	}
+}
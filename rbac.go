@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Roles, each allowing everything the ones before it do.
+const (
+	roleViewer       = "viewer"
+	roleReserver     = "reserver"
+	roleNetworkAdmin = "network-admin"
+	roleAdmin        = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleReserver: 2, roleNetworkAdmin: 3, roleAdmin: 4}
+
+// rolePermissions describes what the roles allow: viewers see networks,
+// their IPs and reservations, reservers reserve IPs and change their own
+// reservations, network admins define networks and change the reservations
+// of others, admins manage netmgmt itself, like its DNS cache.
+var rolePermissions = map[string][]string{
+	roleViewer:       {"view"},
+	roleReserver:     {"view", "reserve"},
+	roleNetworkAdmin: {"view", "reserve", "manage"},
+	roleAdmin:        {"view", "reserve", "manage", "admin"},
+}
+
+// binding assigns a role to users and groups, "*" standing for everyone
+// who is authenticated. The role is scoped to the networks in one of DCs,
+// with one of the names in Networks or with one of Tags, and global if
+// none of them are given.
+type binding struct {
+	Role     string   `yaml:"role" json:"role"`
+	Users    []string `yaml:"users" json:"-"`
+	Groups   []string `yaml:"groups" json:"-"`
+	DCs      []string `yaml:"dcs" json:"dcs,omitempty"`
+	Networks []string `yaml:"networks" json:"networks,omitempty"`
+	Tags     []string `yaml:"tags" json:"tags,omitempty"`
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (b binding) global() bool {
+	return len(b.DCs) == 0 && len(b.Networks) == 0 && len(b.Tags) == 0
+}
+
+// covers reports whether n is in the scope of the binding. nil stands for
+// netmgmt itself, which only global bindings cover.
+func (b binding) covers(n *network) bool {
+	if b.global() {
+		return true
+	}
+	if n == nil {
+		return false
+	}
+	if (n.DC != "" && contains(b.DCs, n.DC)) || contains(b.Networks, n.Name) {
+		return true
+	}
+	for _, tag := range n.Tags {
+		if contains(b.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo reports whether the binding assigns its role to user, a member
+// of groups.
+func (b binding) appliesTo(user string, groups []string) bool {
+	if contains(b.Users, "*") || contains(b.Users, user) {
+		return true
+	}
+	for _, g := range groups {
+		if contains(b.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// policy holds the groups and role bindings of the file at path, which is
+// read again whenever it changes.
+type policy struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	groups  map[string][]string
+	roles   []binding
+}
+
+// newPolicy reads the policy file at path, like:
+//
+//	groups:
+//	  netops: [alice, bob]
+//	roles:
+//	  - role: network-admin
+//	    groups: [netops]
+//	    dcs: [dc1]
+//	  - role: viewer
+//	    users: ["*"]
+func newPolicy(path string) (*policy, error) {
+	p := &policy{path: path}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// load reads the file if it changed since it was read last.
+func (p *policy) load() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	if !p.modTime.IsZero() && info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var read struct {
+		Groups map[string][]string `yaml:"groups"`
+		Roles  []binding           `yaml:"roles"`
+	}
+	if err := yaml.Unmarshal(data, &read); err != nil {
+		return fmt.Errorf("%s: %v", p.path, err)
+	}
+	if err := checkPolicyKeys(data); err != nil {
+		return fmt.Errorf("%s: %v", p.path, err)
+	}
+	for i, b := range read.Roles {
+		if roleRank[b.Role] == 0 {
+			return fmt.Errorf("%s: role %d: unknown role %q, expected viewer, reserver, network-admin or admin", p.path, i+1, b.Role)
+		}
+		if len(b.Users) == 0 && len(b.Groups) == 0 {
+			return fmt.Errorf("%s: role %d: %s is assigned to neither users nor groups", p.path, i+1, b.Role)
+		}
+	}
+
+	p.groups = read.Groups
+	p.roles = read.Roles
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	return nil
+}
+
+// checkPolicyKeys fails on keys which are not known, as a misspelt scope
+// would turn a role into a global one.
+func checkPolicyKeys(data []byte) error {
+	var raw struct {
+		Top   map[string]interface{}   `yaml:",inline"`
+		Roles []map[string]interface{} `yaml:"roles"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key := range raw.Top {
+		if key != "groups" {
+			return fmt.Errorf("unknown key %q, expected groups or roles", key)
+		}
+	}
+	known := map[string]bool{}
+	t := reflect.TypeOf(binding{})
+	for i := 0; i < t.NumField(); i++ {
+		known[t.Field(i).Tag.Get("yaml")] = true
+	}
+	for i, b := range raw.Roles {
+		for key := range b {
+			if !known[key] {
+				return fmt.Errorf("role %d: unknown key %q", i+1, key)
+			}
+		}
+	}
+	return nil
+}
+
+// assign returns the groups of user and the bindings which apply to it.
+func (p *policy) assign(user string) ([]string, []binding) {
+	p.Lock()
+	defer p.Unlock()
+
+	// keep the policy as it is while the file is broken
+	if err := p.load(); err != nil {
+		log.Printf("could not reload policy: %v", err)
+	}
+
+	var groups []string
+	for g, members := range p.groups {
+		if contains(members, user) {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+
+	var out []binding
+	for _, b := range p.roles {
+		if b.appliesTo(user, groups) {
+			out = append(out, b)
+		}
+	}
+	return groups, out
+}
+
+// role returns the highest role id has on n, or an empty string if it has
+// none. nil stands for netmgmt itself.
+func (id *identity) role(n *network) string {
+	role := ""
+	for _, b := range id.Roles {
+		if b.covers(n) && roleRank[b.Role] > roleRank[role] {
+			role = b.Role
+		}
+	}
+	return role
+}
+
+// can reports whether id has at least role on n.
+func (id *identity) can(role string, n *network) bool {
+	return roleRank[id.role(n)] >= roleRank[role]
+}
+
+// networkPermissions are the permissions of a user on a network.
+type networkPermissions struct {
+	Network     string   `json:"network"`
+	DC          string   `json:"dc"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// whoami describes a user and what it may do.
+type whoami struct {
+	*identity
+	Authenticated bool                 `json:"authenticated"`
+	Global        string               `json:"global_role"`
+	Permissions   []string             `json:"global_permissions"`
+	Networks      []networkPermissions `json:"networks"`
+}
+
+// effective returns the permissions of id on netmgmt and on each network.
+func (id *identity) effective(list []*network) whoami {
+	w := whoami{
+		identity:      id,
+		Authenticated: auth.Enabled(),
+		Global:        id.role(nil),
+		Permissions:   rolePermissions[id.role(nil)],
+		Networks:      []networkPermissions{},
+	}
+	if w.Permissions == nil {
+		w.Permissions = []string{}
+	}
+	for _, n := range list {
+		role := id.role(n)
+		if role == "" {
+			continue
+		}
+		w.Networks = append(w.Networks, networkPermissions{
+			Network:     n.Name,
+			DC:          n.DC,
+			Role:        role,
+			Permissions: rolePermissions[role],
+		})
+	}
+	sort.Slice(w.Networks, func(i, j int) bool {
+		return w.Networks[i].Network < w.Networks[j].Network
+	})
+	return w
+}
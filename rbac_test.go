@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unrolled/render"
+)
+
+const testPolicy = `groups:
+  netops: [alice]
+  dbas: [dave]
+roles:
+  - role: network-admin
+    groups: [netops]
+    dcs: [dc1]
+  - role: reserver
+    groups: [dbas]
+    networks: [db]
+  - role: reserver
+    users: [erin]
+    tags: [lab]
+  - role: viewer
+    users: ["*"]
+    dcs: [dc1]
+`
+
+func writePolicy(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown role":    "roles:\n  - role: owner\n    users: [alice]\n",
+		"nobody assigned": "roles:\n  - role: viewer\n    dcs: [dc1]\n",
+		// a misspelt scope would make the role global
+		"unknown scope":      "roles:\n  - role: admin\n    users: [alice]\n    dc: [dc1]\n",
+		"unknown top key":    "group:\n  netops: [alice]\n",
+		"invalid YAML":       "roles: [",
+		"users are not list": "roles:\n  - role: viewer\n    users: alice\n",
+	}
+	dir := t.TempDir()
+	for name, data := range tests {
+		path := filepath.Join(dir, "policy.yaml")
+		writePolicy(t, path, data)
+		if _, err := newPolicy(path); err == nil {
+			t.Errorf("%s: policy was accepted", name)
+		}
+	}
+	if _, err := newPolicy(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("missing policy file was accepted")
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, testPolicy)
+	p, err := newPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, roles := p.assign("alice")
+	if !reflect.DeepEqual(groups, []string{"netops"}) || len(roles) != 2 {
+		t.Fatalf("alice has groups %v and roles %v", groups, roles)
+	}
+
+	// a changed file is read again with the next request
+	writePolicy(t, path, testPolicy+"  - role: admin\n    users: [alice]\n")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if _, roles := p.assign("alice"); len(roles) != 3 {
+		t.Errorf("alice has roles %v after the change, want 3", roles)
+	}
+
+	// a broken file leaves the policy as it was
+	writePolicy(t, path, "roles:\n  - role: owner\n    users: [alice]\n")
+	later = later.Add(time.Second)
+	os.Chtimes(path, later, later)
+	if _, roles := p.assign("alice"); len(roles) != 3 {
+		t.Errorf("alice has roles %v after breaking the file, want 3", roles)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, path, testPolicy)
+	p, err := newPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := &network{Name: "web", DC: "dc1", Tags: []string{"web"}}
+	db := &network{Name: "db", DC: "dc2"}
+	lab := &network{Name: "lab", DC: "dc2", Tags: []string{"lab", "test"}}
+
+	tests := []struct {
+		user        string
+		defaultRole string
+		role        string
+		n           *network
+		allowed     bool
+	}{
+		// scoped by DC
+		{"alice", "", roleNetworkAdmin, web, true},
+		{"alice", "", roleAdmin, web, false},
+		{"alice", "", roleViewer, db, false},
+		{"alice", "", roleViewer, nil, false},
+		// scoped by network name, and everyone views dc1
+		{"dave", "", roleReserver, db, true},
+		{"dave", "", roleNetworkAdmin, db, false},
+		{"dave", "", roleViewer, web, true},
+		{"dave", "", roleReserver, web, false},
+		{"dave", "", roleViewer, lab, false},
+		// scoped by tag
+		{"erin", "", roleReserver, lab, true},
+		{"erin", "", roleNetworkAdmin, lab, false},
+		{"erin", "", roleViewer, db, false},
+		// admins have every role everywhere
+		{"root", "", roleAdmin, nil, true},
+		{"root", "", roleNetworkAdmin, db, true},
+		// the default role is global
+		{"mallory", "", roleViewer, web, true},
+		{"mallory", "", roleViewer, db, false},
+		{"mallory", roleViewer, roleViewer, db, true},
+		{"mallory", roleViewer, roleViewer, nil, true},
+		{"mallory", roleViewer, roleReserver, lab, false},
+		{"erin", roleViewer, roleReserver, lab, true},
+	}
+	for _, tt := range tests {
+		a := &Auth{Policy: p, Admins: map[string]bool{"root": true}, DefaultRole: tt.defaultRole}
+		id := a.newIdentity(tt.user)
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), identityKey, id))
+		res := httptest.NewRecorder()
+
+		allowed := authorize(res, req, render.New(), tt.role, tt.n)
+		name := "netmgmt"
+		if tt.n != nil {
+			name = tt.n.Name
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s (default %q) as %s on %s: allowed %v, want %v", tt.user, tt.defaultRole, tt.role, name, allowed, tt.allowed)
+			continue
+		}
+		if !allowed && (res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "requires the role "+tt.role)) {
+			t.Errorf("%s as %s on %s: %d %s", tt.user, tt.role, name, res.Code, res.Body)
+		}
+	}
+
+	// without authentication everybody may do everything
+	req := httptest.NewRequest("GET", "/", nil)
+	if !authorize(httptest.NewRecorder(), req, render.New(), roleAdmin, nil) {
+		t.Error("an anonymous request was denied while authentication is disabled")
+	}
+
+	a := &Auth{Policy: p}
+	req = req.WithContext(context.WithValue(req.Context(), identityKey, a.newIdentity("dave")))
+	var names []string
+	for _, n := range visible(req, []*network{web, db, lab}) {
+		names = append(names, n.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"web", "db"}) {
+		t.Errorf("dave sees %v, want web and db", names)
+	}
+
+	// reservations may be changed by their owner and the network admins
+	lock := Lock{Owner: "dave"}
+	for user, want := range map[string]bool{"dave": true, "alice": true, "erin": false} {
+		if got := a.newIdentity(user).mayChange(lock, web); got != want {
+			t.Errorf("%s may change the lock of dave: %v, want %v", user, got, want)
+		}
+	}
+}
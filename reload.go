@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// networksMu protects networks, which is replaced as a whole whenever the
+// definitions change and never modified in place.
+var networksMu sync.RWMutex
+
+// getNetworks returns the current networks.
+func getNetworks() []*network {
+	networksMu.RLock()
+	defer networksMu.RUnlock()
+
+	return networks
+}
+
+// setNetworks replaces the networks with list.
+func setNetworks(list []*network) {
+	networksMu.Lock()
+	defer networksMu.Unlock()
+
+	networks = list
+}
+
+// loadNetworks reads and checks the network definitions in the file at
+// path. Warnings are logged, errors make it fail.
+func loadNetworks(path string) ([]*network, error) {
+	list, issues, err := lintFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range issues {
+		log.Print(i.format(path))
+	}
+	if n := countErrors(issues); n > 0 {
+		return nil, fmt.Errorf("%d errors in %s", n, path)
+	}
+	return list, nil
+}
+
+// sameDefinition reports whether two networks are defined the same way,
+// apart from what netmgmt computes at runtime.
+func sameDefinition(a, b *network) bool {
+	x, y := *a, *b
+	x.Utilization, y.Utilization = utilization{}, utilization{}
+	return reflect.DeepEqual(x, y)
+}
+
+// reloadNetworks reads the network definitions in the file at path again
+// and replaces the networks with them. If they are invalid, the networks
+// are left as they are. Scans of networks which changed or were removed
+// are dropped, and so are the names of the zones to transfer.
+func reloadNetworks(path string) error {
+	netdefMu.Lock()
+	defer netdefMu.Unlock()
+
+	list, err := loadNetworks(path)
+	if err != nil {
+		return err
+	}
+
+	old := make(map[string]*network)
+	for _, n := range getNetworks() {
+		old[n.Name] = n
+	}
+	for _, n := range list {
+		if o, ok := old[n.Name]; !ok || !sameDefinition(o, n) {
+			scanner.Forget(n.Name)
+		}
+		delete(old, n.Name)
+	}
+	for name := range old {
+		scanner.Forget(name)
+	}
+	if transfers != nil {
+		transfers.Forget()
+	}
+
+	setNetworks(list)
+	return nil
+}
+
+// watchNetworks reloads the network definitions when the file at path is
+// modified, which is checked every interval, or when SIGHUP is received. An
+// interval of 0 only reloads on SIGHUP.
+func watchNetworks(path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	last, _ := os.Stat(path)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				last, _ = os.Stat(path)
+				log.Printf("reloading network definitions from %s", path)
+			case <-tick:
+				fi, err := os.Stat(path)
+				if err != nil || (last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size()) {
+					continue
+				}
+				last = fi
+				log.Printf("network definitions in %s changed, reloading", path)
+			}
+			if err := reloadNetworks(path); err != nil {
+				log.Printf("keeping the current network definitions: %v", err)
+				continue
+			}
+			log.Printf("loaded %d networks from %s", len(getNetworks()), path)
+		}
+	}()
+}
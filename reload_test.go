@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadNetworks(t *testing.T) {
+	useScanner(t)
+	saved := getNetworks()
+	t.Cleanup(func() { setNetworks(saved) })
+
+	path := filepath.Join(t.TempDir(), "netdef.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`- name: first
+  cidr: 192.0.2.0/24
+- name: second
+  cidr: 198.51.100.0/24
+- name: gone
+  cidr: 203.0.113.0/24
+`)
+	list, err := loadNetworks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setNetworks(list)
+	for _, n := range list {
+		scanner.scans[n.Name] = &scan{Network: n.Name}
+	}
+
+	write(`- name: first
+  cidr: 192.0.2.0/24
+- name: second
+  description: changed
+  cidr: 198.51.100.0/24
+- name: third
+  cidr: 203.0.113.0/24
+`)
+	if err := reloadNetworks(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := findNetwork("second"); n == nil || n.Description != "changed" {
+		t.Errorf("second = %+v, want the new definition", n)
+	}
+	if findNetwork("gone") != nil || findNetwork("third") == nil {
+		t.Errorf("networks = %v", getNetworks())
+	}
+	// only the scans of unchanged networks are kept
+	for name, kept := range map[string]bool{"first": true, "second": false, "gone": false} {
+		if got := scanner.Get(name) != nil; got != kept {
+			t.Errorf("scan of %s kept: %v, want %v", name, got, kept)
+		}
+	}
+
+	// invalid definitions leave the networks as they are
+	before := getNetworks()
+	write(`- name: first
+  cidr: 192.0.2.0/33
+`)
+	if err := reloadNetworks(path); err == nil {
+		t.Error("invalid definitions were loaded")
+	}
+	if after := getNetworks(); len(after) != len(before) || after[0] != before[0] {
+		t.Errorf("networks = %v, want %v", after, before)
+	}
+	if scanner.Get("first") == nil {
+		t.Error("scan of first was dropped by a failed reload")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// reclaimCandidate is an IP which is probably not used the way DNS says.
+type reclaimCandidate struct {
+	Network  string    `json:"network"`
+	IP       string    `json:"ip"`
+	Name     string    `json:"name"`
+	LastSeen time.Time `json:"last_seen"`
+	Lock     Lock      `json:"lock"`
+}
+
+// reclaimReport lists IPs with a PTR which did not answer ping for a while
+// (zombie DNS) and IPs which answer ping without having a PTR (undocumented
+// live hosts). Networks which were not scanned yet are listed as unscanned.
+type reclaimReport struct {
+	Days         int                `json:"days"`
+	ZombieDNS    []reclaimCandidate `json:"zombie_dns"`
+	Undocumented []reclaimCandidate `json:"undocumented"`
+	Unscanned    []string           `json:"unscanned"`
+}
+
+func newReclaimReport(days int) *reclaimReport {
+	return &reclaimReport{
+		Days:         days,
+		ZombieDNS:    []reclaimCandidate{},
+		Undocumented: []reclaimCandidate{},
+		Unscanned:    []string{},
+	}
+}
+
+// add adds the candidates of a network to the report, based on a scan of
+// it and the recorded history, or lists it as unscanned if sc is nil.
+func (rep *reclaimReport) add(n *network, sc *scan) {
+	if sc == nil {
+		rep.Unscanned = append(rep.Unscanned, n.Name)
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -rep.Days)
+	for ip, r := range sc.fresh().results {
+		candidate := reclaimCandidate{
+			Network:  n.Name,
+			IP:       ip,
+			Name:     r.Name,
+			LastSeen: r.LastSeen,
+			Lock:     r.Lock,
+		}
+
+		switch {
+		case r.Name != "" && !r.Pingable:
+			// without a ping ever recorded, count from when the PTR was
+			// first seen
+			seen := r.LastSeen
+			if h, ok := history.Get(ip); ok && seen.IsZero() {
+				seen = h.FirstSeen
+			}
+			if !seen.IsZero() && seen.Before(since) {
+				rep.ZombieDNS = append(rep.ZombieDNS, candidate)
+			}
+		case r.Name == "" && r.Pingable && r.Unmanaged == "":
+			rep.Undocumented = append(rep.Undocumented, candidate)
+		}
+	}
+}
+
+func (rep *reclaimReport) sort() {
+	sort.Strings(rep.Unscanned)
+	for _, list := range [][]reclaimCandidate{rep.ZombieDNS, rep.Undocumented} {
+		list := list
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Network != list[j].Network {
+				return list[i].Network < list[j].Network
+			}
+			return compareIP(net.ParseIP(list[i].IP), net.ParseIP(list[j].IP)) < 0
+		})
+	}
+}
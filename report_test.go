@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useHistory replaces the global history with an empty one kept in memory
+// for the duration of a test.
+func useHistory(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		if err := history.Init("memory"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func candidateIPs(list []reclaimCandidate) []string {
+	out := []string{}
+	for _, c := range list {
+		out = append(out, c.Network+" "+c.IP)
+	}
+	return out
+}
+
+func TestReclaimReport(t *testing.T) {
+	useScanner(t)
+	useLocker(t)
+	useHistory(t)
+	useNetworks(t, `- name: a
+  cidr: 192.0.2.0/24
+  dhcp:
+    - start: 192.0.2.100
+      end: 192.0.2.150
+- name: b
+  cidr: 198.51.100.0/24
+- name: pool
+  cidr: 203.0.113.0/24
+  container: true
+`)
+
+	now := time.Now()
+	days := func(d int) time.Time { return now.AddDate(0, 0, -d) }
+	result := func(ip string, name string, pingable bool) *ResultSet {
+		return &ResultSet{IP: net.ParseIP(ip), Name: name, Pingable: pingable}
+	}
+	// what earlier scans saw
+	history.Record(map[string]*ResultSet{
+		"192.0.2.3": result("192.0.2.3", "never.example.com.", false),
+	}, days(60))
+	history.Record(map[string]*ResultSet{
+		"192.0.2.1": result("192.0.2.1", "old.example.com.", true),
+	}, days(40))
+	history.Record(map[string]*ResultSet{
+		"192.0.2.2": result("192.0.2.2", "recent.example.com.", true),
+	}, days(10))
+	history.Record(map[string]*ResultSet{
+		"192.0.2.4": result("192.0.2.4", "new.example.com.", false),
+	}, days(5))
+
+	dhcp := result("192.0.2.120", "", true)
+	dhcp.Unmanaged = "DHCP"
+	scanner.scans["a"] = &scan{Network: "a", results: map[string]*ResultSet{
+		// no ping for 40 days
+		"192.0.2.1": result("192.0.2.1", "old.example.com.", false),
+		// no ping for 10 days only
+		"192.0.2.2": result("192.0.2.2", "recent.example.com.", false),
+		// never answered in 60 days
+		"192.0.2.3": result("192.0.2.3", "never.example.com.", false),
+		// never answered, but only known for 5 days
+		"192.0.2.4": result("192.0.2.4", "new.example.com.", false),
+		// never recorded by a scan
+		"192.0.2.5":   result("192.0.2.5", "unknown.example.com.", false),
+		"192.0.2.6":   result("192.0.2.6", "", false),
+		"192.0.2.7":   result("192.0.2.7", "live.example.com.", true),
+		"192.0.2.10":  result("192.0.2.10", "", true),
+		"192.0.2.9":   result("192.0.2.9", "", true),
+		"192.0.2.120": dhcp,
+	}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/networks/{net}/reclaim", GetNetworkReclaim).Methods("GET")
+	router.HandleFunc("/reclaim", GetReclaim).Methods("GET")
+
+	res := request(router, "GET", "/reclaim", "")
+	var rep reclaimReport
+	if err := json.Unmarshal(res.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("%d %s: %v", res.Code, res.Body, err)
+	}
+	if rep.Days != 30 {
+		t.Errorf("days = %d, want the default of 30", rep.Days)
+	}
+	if got, want := candidateIPs(rep.ZombieDNS), []string{"a 192.0.2.1", "a 192.0.2.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("zombie DNS = %v, want %v", got, want)
+	}
+	// sorted by address, not as strings
+	if got, want := candidateIPs(rep.Undocumented), []string{"a 192.0.2.9", "a 192.0.2.10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("undocumented = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(rep.Unscanned, []string{"b"}) {
+		t.Errorf("unscanned = %v, want only b", rep.Unscanned)
+	}
+
+	res = request(router, "GET", "/networks/a/reclaim?days=7", "")
+	rep = reclaimReport{}
+	if err := json.Unmarshal(res.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("%d %s: %v", res.Code, res.Body, err)
+	}
+	if got, want := candidateIPs(rep.ZombieDNS), []string{"a 192.0.2.1", "a 192.0.2.2", "a 192.0.2.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("zombie DNS within 7 days = %v, want %v", got, want)
+	}
+
+	for target, status := range map[string]int{
+		"/reclaim?days=-1":         http.StatusBadRequest,
+		"/reclaim?days=week":       http.StatusBadRequest,
+		"/networks/pool/reclaim":   http.StatusBadRequest,
+		"/networks/none/reclaim":   http.StatusNotFound,
+		"/networks/a/reclaim?days": http.StatusOK,
+	} {
+		if res := request(router, "GET", target, ""); res.Code != status {
+			t.Errorf("%s: %d %s, want %d", target, res.Code, res.Body, status)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,16 +16,31 @@ type Resolver struct {
 	mu     sync.Mutex
 	OnRecv func([]*Response)
 	OnIdle func()
+	// OnDone is called, if set, with every address which was looked up and
+	// the error of the lookup
+	OnDone func(addr string, err error)
 	Debug  bool
+	// DNS resolves the addresses, the system resolver by default
+	DNS dnsLookup
+	// Workers is the number of addresses resolved in parallel, Timeout
+	// the time after which resolving an address is given up.
+	Workers int
+	Timeout time.Duration
+	// Failures is set by Run to the number of addresses which could not
+	// be resolved for other reasons than not having a record.
+	Failures int
 }
 
 func NewResolver() *Resolver {
 	rand.Seed(time.Now().UnixNano())
 	return &Resolver{
-		addrs:  []*string{},
-		OnRecv: nil,
-		OnIdle: nil,
-		Debug:  false,
+		addrs:   []*string{},
+		OnRecv:  nil,
+		OnIdle:  nil,
+		Debug:   false,
+		DNS:     systemDNS{},
+		Workers: dnsConfig.Workers,
+		Timeout: dnsConfig.LookupTimeout,
 	}
 }
 
@@ -44,21 +62,63 @@ func (r *Resolver) RemoveAddr(addr string) error {
 	return nil
 }
 
-func (r *Resolver) Run() error {
-	var wg sync.WaitGroup
-	var err error
+// errLookupTimeout is returned by Run if some addresses could not be
+// resolved in time.
+var errLookupTimeout = errors.New("lookups timed out")
+
+// Run resolves all addresses. It stops when ctx is done and returns its
+// error, some addresses are then left unresolved. If the lookups of some
+// addresses timed out, it returns errLookupTimeout.
+func (r *Resolver) Run(ctx context.Context) error {
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
 
-	for _, addr := range r.addrs {
+	addrs := make(chan string)
+	var timeouts, failures int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(addr *string, err error) {
+		go func() {
 			defer wg.Done()
-			re, err := Resolv(*addr)
-			r.OnRecv(re)
-		}(addr, err)
+			for addr := range addrs {
+				lookupCtx, cancel := context.WithTimeout(ctx, r.Timeout)
+				re, err := resolv(lookupCtx, r.DNS, addr)
+				cancel()
+				if e, ok := err.(*net.DNSError); ok && e.IsTimeout {
+					atomic.AddInt32(&timeouts, 1)
+				}
+				if e, ok := err.(*net.DNSError); err != nil && !(ok && e.IsNotFound) {
+					atomic.AddInt32(&failures, 1)
+				}
+				r.OnRecv(re)
+				if r.OnDone != nil {
+					r.OnDone(addr, err)
+				}
+			}
+		}()
 	}
+
+feed:
+	for _, addr := range r.addrs {
+		select {
+		case addrs <- *addr:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(addrs)
 	wg.Wait()
+	r.Failures = int(failures)
 	r.OnIdle()
-	return err
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if timeouts > 0 {
+		return errLookupTimeout
+	}
+	return nil
 }
 
 type Response struct {
@@ -69,27 +129,31 @@ type Response struct {
 	CNAME string `json:"cname"`
 }
 
-func Resolv(in string) ([]*Response, error) {
+func Resolv(ctx context.Context, in string) ([]*Response, error) {
+	return resolv(ctx, systemDNS{}, in)
+}
+
+func resolv(ctx context.Context, dns dnsLookup, in string) ([]*Response, error) {
 	ip := net.ParseIP(in)
 	if ip != nil {
 		// Input is an IP Address
-		return resolvIP(ip)
+		return resolvIP(ctx, dns, ip)
 	} else {
 		// Input is a CNAME or an APTR
-		return resolvName(in)
+		return resolvName(ctx, dns, in)
 	}
 }
 
-func resolvIP(ip net.IP) ([]*Response, error) {
+func resolvIP(ctx context.Context, dns dnsLookup, ip net.IP) ([]*Response, error) {
 	var sets []*Response
-	aptrs, err := net.LookupAddr(ip.String())
+	aptrs, err := dns.LookupAddr(ctx, ip.String())
 	if err != nil {
 		return sets, err
 	}
 	for _, aptr := range aptrs {
-		txt := resolvTXT(aptr)
+		txt := resolvTXT(ctx, dns, aptr)
 		var arec net.IP
-		reverse, _ := resolvName(aptr)
+		reverse, _ := resolvName(ctx, dns, aptr)
 		if len(reverse) > 0 {
 			fr := *reverse[0]
 			arec = fr.Addr
@@ -104,12 +168,12 @@ func resolvIP(ip net.IP) ([]*Response, error) {
 	return sets, nil
 }
 
-func resolvTXT(addr string) string {
-	txts, _ := net.LookupTXT(addr)
+func resolvTXT(ctx context.Context, dns dnsLookup, addr string) string {
+	txts, _ := dns.LookupTXT(ctx, addr)
 	return strings.Join(txts, ", ")
 }
 
-func resolvName(name string) ([]*Response, error) {
+func resolvName(ctx context.Context, dns dnsLookup, name string) ([]*Response, error) {
 	var sets []*Response
 	isCNAME := true
 
@@ -119,7 +183,7 @@ func resolvName(name string) ([]*Response, error) {
 	}
 
 	// check if there name is a CNAME
-	aptr, err := net.LookupCNAME(name)
+	aptr, err := dns.LookupCNAME(ctx, name)
 	if err != nil {
 		return sets, err
 	}
@@ -128,14 +192,14 @@ func resolvName(name string) ([]*Response, error) {
 	}
 
 	// get IP address
-	addrs, err := net.LookupHost(name)
+	addrs, err := dns.LookupHost(ctx, name)
 	if err != nil {
 		return sets, err
 	}
 
 	// return a DNSSet for each address
 	for _, addr := range addrs {
-		txt := resolvTXT(name)
+		txt := resolvTXT(ctx, dns, name)
 		if isCNAME {
 			sets = append(sets, &Response{
 				Addr:  net.ParseIP(addr),
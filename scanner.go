@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// scan holds the results of the last check of a network.
+type scan struct {
+	Network     string      `json:"network"`
+	Started     time.Time   `json:"started"`
+	Finished    time.Time   `json:"finished"`
+	Utilization utilization `json:"utilization"`
+	Error       string      `json:"error,omitempty"`
+	Incomplete  bool        `json:"incomplete"`
+	DNSErrors   int         `json:"dns_errors"`
+	Pinged      int         `json:"pinged"`
+	PingReplies int         `json:"ping_replies"`
+	results     map[string]*ResultSet
+	// unresolved holds the IPs whose names are unknown, as their lookup
+	// failed
+	unresolved map[string]bool
+}
+
+// fresh returns a check holding a copy of the cached results, with the
+// current locks applied.
+func (s *scan) fresh() *check {
+	c := &check{results: make(map[string]*ResultSet, len(s.results))}
+	for ip, r := range s.results {
+		res := *r
+		c.results[ip] = &res
+	}
+	c.isLocked()
+	c.isSeen()
+	c.getFree()
+	return c
+}
+
+// Scanner periodically checks all networks in the background and caches
+// the results, so that requests don't have to wait for DNS and ping.
+type Scanner struct {
+	sync.RWMutex
+	interval time.Duration
+	timeout  time.Duration
+	scans    map[string]*scan
+	running  map[string]chan struct{}
+}
+
+// Init sets the interval of background scans and the time a scan may take,
+// both in minutes.
+func (s *Scanner) Init(interval int, timeout int) {
+	s.interval = time.Duration(interval) * time.Minute
+	s.timeout = time.Duration(timeout) * time.Minute
+	s.scans = make(map[string]*scan)
+	s.running = make(map[string]chan struct{})
+}
+
+// Start scans all networks every interval. An interval of 0 disables
+// background scanning, networks are then only scanned on demand.
+func (s *Scanner) Start() {
+	if s.interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			for _, n := range getNetworks() {
+				if n.Container {
+					continue
+				}
+				if _, err := s.Scan(n); err != nil {
+					log.Printf("scan of network %s failed: %v", n.Name, err)
+				}
+			}
+			time.Sleep(s.interval)
+		}
+	}()
+}
+
+// Get returns the last scan of a network, or nil if it was never scanned.
+func (s *Scanner) Get(name string) *scan {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.scans[name]
+}
+
+// Forget drops the last scan of a network, after its definition changed.
+func (s *Scanner) Forget(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.scans, name)
+}
+
+// Latest returns the last scan of a network, scanning it if there is none.
+func (s *Scanner) Latest(n *network) (*scan, error) {
+	if sc := s.Get(n.Name); sc != nil {
+		return sc, nil
+	}
+	return s.Scan(n)
+}
+
+// Scan checks a network and caches the result. If the network is already
+// being scanned, it waits for that scan instead of starting another one.
+func (s *Scanner) Scan(n *network) (*scan, error) {
+	s.Lock()
+	if wait, ok := s.running[n.Name]; ok {
+		s.Unlock()
+		<-wait
+		return s.Get(n.Name), nil
+	}
+	done := make(chan struct{})
+	s.running[n.Name] = done
+	s.Unlock()
+
+	sc := &scan{
+		Network: n.Name,
+		Started: time.Now(),
+	}
+	ips, err := n.ExpandDetailed()
+	if err == nil {
+		c := NewCheck(n, ips)
+		if transfers != nil {
+			if c.zones, err = transfers.Zones(n); err != nil {
+				log.Printf("resolving network %s with DNS queries: %v", n.Name, err)
+				err = nil
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		c.Run(ctx)
+		cancel()
+		sc.results = c.results
+		sc.unresolved = c.unresolved
+		sc.Utilization = c.utilization
+		sc.Incomplete = c.incomplete
+		sc.DNSErrors = c.dnsErrors
+		sc.Pinged = c.pinged
+		sc.PingReplies = c.pingReplies
+		if c.incomplete {
+			log.Printf("scan of network %s did not complete within %v", n.Name, s.timeout)
+		} else {
+			history.Record(c.results, time.Now())
+			alerts.Evaluate(n, c.utilization)
+			if old := s.Get(n.Name); old != nil && !old.Incomplete && old.Error == "" && old.results != nil {
+				events.RecordScan(old, sc)
+			}
+		}
+	} else {
+		sc.Error = err.Error()
+	}
+	sc.Finished = time.Now()
+	metrics.RecordScan(sc)
+
+	s.Lock()
+	if old := s.scans[n.Name]; err != nil && old != nil {
+		// keep serving the results of the last successful scan
+		sc.results = old.results
+		sc.unresolved = old.unresolved
+		sc.Utilization = old.Utilization
+	}
+	s.scans[n.Name] = sc
+	delete(s.running, n.Name)
+	close(done)
+	s.Unlock()
+
+	return sc, err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// useScanner replaces the global scanner with an empty one for the
+// duration of a test.
+func useScanner(t *testing.T) {
+	t.Helper()
+	scanner.Init(0, 1)
+	t.Cleanup(func() { scanner.Init(0, 1) })
+}
+
+func TestScannerCache(t *testing.T) {
+	useScanner(t)
+	n := &network{Name: "test", CIDR: "192.0.2.0/24"}
+
+	if sc := scanner.Get(n.Name); sc != nil {
+		t.Fatalf("Get returned %+v before the first scan", sc)
+	}
+	if got := withUtilization(n).Utilization; got != (utilization{}) {
+		t.Errorf("utilization without a scan = %+v", got)
+	}
+
+	cached := &scan{Network: n.Name, Utilization: utilization{Total: 254, Used: 4, Free: 250, UsedPercent: 1, FreePercent: 98}}
+	scanner.scans[n.Name] = cached
+	if sc := scanner.Get(n.Name); sc != cached {
+		t.Errorf("Get = %+v, want the cached scan", sc)
+	}
+	if sc, err := scanner.Latest(n); err != nil || sc != cached {
+		t.Errorf("Latest = %+v, %v, want the cached scan", sc, err)
+	}
+	out := withUtilization(n)
+	if out.Utilization != cached.Utilization {
+		t.Errorf("utilization = %+v, want %+v", out.Utilization, cached.Utilization)
+	}
+	if n.Utilization != (utilization{}) {
+		t.Error("withUtilization changed the shared network")
+	}
+
+	scanner.Forget(n.Name)
+	if sc := scanner.Get(n.Name); sc != nil {
+		t.Errorf("Get returned %+v after Forget", sc)
+	}
+}
+
+func TestScannerFailedScan(t *testing.T) {
+	useScanner(t)
+	n := &network{Name: "test", CIDR: "192.0.2.0"}
+	old := &scan{
+		Network:     n.Name,
+		Utilization: utilization{Total: 1, Used: 1},
+		results:     map[string]*ResultSet{"192.0.2.1": {IP: net.ParseIP("192.0.2.1"), Pingable: true}},
+	}
+	scanner.scans[n.Name] = old
+
+	sc, err := scanner.Scan(n)
+	if err == nil {
+		t.Fatal("scan of an invalid network succeeded")
+	}
+	if sc.Error == "" || sc.Finished.IsZero() {
+		t.Errorf("scan = %+v, want the error and the time it finished", sc)
+	}
+	// the results of the last scan are still served
+	if scanner.Get(n.Name) != sc || sc.Utilization != old.Utilization || len(sc.results) != 1 {
+		t.Errorf("scan = %+v, want the results of %+v", sc, old)
+	}
+}
+
+func TestScannerWaitsForRunningScan(t *testing.T) {
+	useScanner(t)
+	n := &network{Name: "test", CIDR: "192.0.2.0/24"}
+	running := make(chan struct{})
+	scanner.running[n.Name] = running
+
+	done := make(chan *scan)
+	go func() {
+		sc, err := scanner.Scan(n)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- sc
+	}()
+
+	finished := &scan{Network: n.Name, Finished: time.Now()}
+	select {
+	case sc := <-done:
+		t.Fatalf("Scan returned %+v while another scan was running", sc)
+	case <-time.After(50 * time.Millisecond):
+	}
+	scanner.Lock()
+	scanner.scans[n.Name] = finished
+	delete(scanner.running, n.Name)
+	close(running)
+	scanner.Unlock()
+
+	if sc := <-done; sc != finished {
+		t.Errorf("Scan = %+v, want the result of the running scan", sc)
+	}
+}
+
+func TestScanFresh(t *testing.T) {
+	useLocker(t, "192.0.2.2")
+	sc := &scan{results: map[string]*ResultSet{
+		"192.0.2.1": {IP: net.ParseIP("192.0.2.1"), Pingable: true},
+		"192.0.2.2": {IP: net.ParseIP("192.0.2.2")},
+		"192.0.2.3": {IP: net.ParseIP("192.0.2.3")},
+	}}
+
+	c := sc.fresh()
+	if !c.results["192.0.2.2"].Lock.Locked() {
+		t.Error("the lock of 192.0.2.2 was not applied")
+	}
+	if sc.results["192.0.2.2"].Lock.Locked() {
+		t.Error("the lock was applied to the cached results")
+	}
+	want := utilization{Total: 3, Used: 2, Free: 1, UsedPercent: 66, FreePercent: 33}
+	if c.utilization != want {
+		t.Errorf("utilization = %+v, want %+v", c.utilization, want)
+	}
+	if !c.results["192.0.2.3"].Free || c.results["192.0.2.1"].Free {
+		t.Errorf("free IPs = %v, want only 192.0.2.3", c.results)
+	}
+}
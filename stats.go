@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// space is how much of the address space of an address family is taken by
+// networks. Size is the space of the containers, Allocated the space of the
+// networks which are not containers.
+type space struct {
+	Family           string   `json:"family"`
+	Size             *big.Int `json:"size"`
+	Allocated        *big.Int `json:"allocated"`
+	AllocatedPercent int      `json:"allocated_percent"`
+}
+
+// usage sums up a group of networks. Utilization counts the addresses of
+// the networks based on their latest scans, leaving out networks which were
+// not scanned yet and those too large to be expanded.
+type usage struct {
+	Networks    int         `json:"networks"`
+	Scanned     int         `json:"scanned"`
+	Utilization utilization `json:"utilization"`
+	Space       []*space    `json:"space"`
+}
+
+// stats holds the usage of all networks, by data center, by VLAN, by
+// supernet and globally.
+type stats struct {
+	Global    *usage            `json:"global"`
+	DCs       map[string]*usage `json:"dcs"`
+	VLANs     map[string]*usage `json:"vlans"`
+	Supernets map[string]*usage `json:"supernets"`
+}
+
+// family returns the name of the address family of a network.
+func family(n *network) string {
+	if n.Bits() == 32 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// addressCount returns the number of addresses of a network.
+func addressCount(n *network) *big.Int {
+	_, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return new(big.Int)
+	}
+	s := cidrSpan(ipnet)
+	return s.end.Sub(s.end, s.start)
+}
+
+// newUsage sums up members, whose address space is the one of containers.
+func newUsage(members []*network, containers []*network) *usage {
+	u := &usage{Space: []*space{}}
+	spaces := make(map[string]*space)
+	spaceOf := func(n *network) *space {
+		f := family(n)
+		if spaces[f] == nil {
+			spaces[f] = &space{Family: f, Size: new(big.Int), Allocated: new(big.Int)}
+			u.Space = append(u.Space, spaces[f])
+		}
+		return spaces[f]
+	}
+
+	for _, c := range containers {
+		s := spaceOf(c)
+		s.Size.Add(s.Size, addressCount(c))
+	}
+	for _, n := range members {
+		if n.Container {
+			continue
+		}
+		u.Networks++
+		s := spaceOf(n)
+		s.Allocated.Add(s.Allocated, addressCount(n))
+
+		sc := scanner.Get(n.Name)
+		if sc == nil || sc.results == nil {
+			continue
+		}
+		u.Scanned++
+		if n.Sparse() {
+			continue
+		}
+		used := sc.fresh().utilization
+		u.Utilization.Total += used.Total
+		u.Utilization.Used += used.Used
+		u.Utilization.Free += used.Free
+	}
+
+	if total := u.Utilization.Total; total > 0 {
+		u.Utilization.UsedPercent = u.Utilization.Used * 100 / total
+		u.Utilization.FreePercent = u.Utilization.Free * 100 / total
+	}
+	for _, s := range u.Space {
+		if s.Size.Sign() > 0 {
+			percent := new(big.Int).Mul(s.Allocated, big.NewInt(100))
+			s.AllocatedPercent = int(percent.Div(percent, s.Size).Int64())
+		}
+	}
+	sort.Slice(u.Space, func(i, j int) bool {
+		return u.Space[i].Family < u.Space[j].Family
+	})
+	return u
+}
+
+// topContainers returns the containers of list which are not part of
+// another container of list.
+func topContainers(list []*network) []*network {
+	var out []*network
+	for _, c := range list {
+		if !c.Container {
+			continue
+		}
+		top := true
+		for _, o := range list {
+			if o != c && o.Encloses(*c) && !(c.Encloses(*o) && o.Name > c.Name) {
+				top = false
+			}
+		}
+		if top {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// usageOf sums up a group of networks, taking the address space of its
+// outermost containers.
+func usageOf(list []*network) *usage {
+	return newUsage(list, topContainers(list))
+}
+
+// vlanKey identifies a VLAN, whose IDs are unique per data center.
+func vlanKey(n *network) string {
+	return fmt.Sprintf("%s:%d", n.DC, n.Vlan.Id)
+}
+
+// collectStats sums up the networks in list.
+func collectStats(list []*network) *stats {
+	s := &stats{
+		Global:    usageOf(list),
+		DCs:       make(map[string]*usage),
+		VLANs:     make(map[string]*usage),
+		Supernets: make(map[string]*usage),
+	}
+
+	dcs := make(map[string][]*network)
+	vlans := make(map[string][]*network)
+	for _, n := range list {
+		if n.DC != "" {
+			dcs[n.DC] = append(dcs[n.DC], n)
+		}
+		if n.Vlan.Id != 0 {
+			vlans[vlanKey(n)] = append(vlans[vlanKey(n)], n)
+		}
+		if n.Container {
+			var members []*network
+			for _, o := range list {
+				if o != n && n.Encloses(*o) {
+					members = append(members, o)
+				}
+			}
+			s.Supernets[n.Name] = newUsage(members, []*network{n})
+		}
+	}
+	for dc, members := range dcs {
+		s.DCs[dc] = usageOf(members)
+	}
+	for key, members := range vlans {
+		s.VLANs[key] = usageOf(members)
+	}
+	return s
+}
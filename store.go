@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LockStore persists the locks held by a Locker, so that reservations
+// survive a restart of netmgmt.
+type LockStore interface {
+	Load() (map[string]Lock, error)
+	Put(ip string, lock Lock) error
+	// PutMany stores all locks or none of them.
+	PutMany(locks map[string]Lock) error
+	Delete(ip string) error
+	Close() error
+}
+
+// storePath parses a store spec of the form "memory" or "file:<path>" and
+// returns the path, which is empty for stores kept in memory only.
+func storePath(spec string) (string, error) {
+	switch {
+	case spec == "" || spec == "memory":
+		return "", nil
+	case strings.HasPrefix(spec, "file:") && len(spec) > len("file:"):
+		return strings.TrimPrefix(spec, "file:"), nil
+	}
+	return "", fmt.Errorf("unknown store %q", spec)
+}
+
+// NewLockStore creates a LockStore from a spec of the form "memory" or
+// "file:<path>".
+func NewLockStore(spec string) (LockStore, error) {
+	path, err := storePath(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{journal: &journal{path: path}}, nil
+}
+
+// fileStore keeps the locks in a journal.
+type fileStore struct {
+	*journal
+}
+
+func (s *fileStore) Load() (map[string]Lock, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]Lock)
+	s.Each(func(ip string, value json.RawMessage) {
+		var lock Lock
+		if err := json.Unmarshal(value, &lock); err != nil {
+			log.Printf("%s: ignoring lock for %s: %v", s.path, ip, err)
+			return
+		}
+		out[ip] = lock
+	})
+	return out, nil
+}
+
+func (s *fileStore) Put(ip string, lock Lock) error {
+	return s.journal.Put(map[string]interface{}{ip: lock})
+}
+
+func (s *fileStore) PutMany(locks map[string]Lock) error {
+	values := make(map[string]interface{}, len(locks))
+	for ip, lock := range locks {
+		values[ip] = lock
+	}
+	return s.journal.Put(values)
+}
+
+// maxJournalEntries is the number of records appended to a journal before
+// it is compacted.
+const maxJournalEntries = 1000
+
+type journalEntry struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	// IP and Lock hold the key and value in records written by the lock
+	// store before it became a journal of any values.
+	IP   string          `json:"ip,omitempty"`
+	Lock json.RawMessage `json:"lock,omitempty"`
+}
+
+// decode moves the key and value of records in the format of the lock
+// store to Key and Value, and reports whether the record can be applied.
+func (e *journalEntry) decode() bool {
+	if e.Key == "" && e.IP != "" {
+		e.Key, e.Value = e.IP, e.Lock
+		e.IP, e.Lock = "", nil
+	}
+	switch e.Op {
+	case "put":
+		return e.Key != "" && len(e.Value) > 0
+	case "delete":
+		return e.Key != ""
+	}
+	return false
+}
+
+// journal is a write-ahead log of JSON values by key on disk. Every change
+// is appended and synced before it is applied in memory. A record torn by
+// a crash is cut off on the next open. If other records can't be read, the
+// journal is not compacted, which would drop them, until they are fixed by
+// hand. A journal without a path is only kept in memory.
+type journal struct {
+	sync.Mutex
+	path       string
+	file       *os.File
+	state      map[string]json.RawMessage
+	entries    int
+	unreadable int
+}
+
+func (j *journal) open() error {
+	j.Lock()
+	defer j.Unlock()
+
+	j.state = make(map[string]json.RawMessage)
+	if j.path == "" {
+		return nil
+	}
+	if err := j.replay(); err != nil {
+		return err
+	}
+	if j.unreadable == 0 {
+		return j.compact()
+	}
+
+	log.Printf("%s: not compacting, as %d records could not be read", j.path, j.unreadable)
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file = f
+	return nil
+}
+
+// replay applies the records of the journal on disk and counts the ones
+// which can't be read.
+func (j *journal) replay() error {
+	j.entries = 0
+	j.unreadable = 0
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line := 0
+	var size int64
+	for {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(b) > 0 {
+				// cut the torn record off, or the next one would be
+				// appended to it
+				log.Printf("%s: ignoring incomplete record at line %d", j.path, line+1)
+				return os.Truncate(j.path, size)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line++
+		size += int64(len(b))
+
+		j.entries++
+		var e journalEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			log.Printf("%s: ignoring corrupt record at line %d: %v", j.path, line, err)
+			j.unreadable++
+			continue
+		}
+		if !e.decode() {
+			log.Printf("%s: ignoring unknown record at line %d", j.path, line)
+			j.unreadable++
+			continue
+		}
+		j.apply(e)
+	}
+}
+
+func (j *journal) apply(e journalEntry) {
+	switch e.Op {
+	case "put":
+		j.state[e.Key] = e.Value
+	case "delete":
+		delete(j.state, e.Key)
+	}
+}
+
+// compact rewrites the journal so it only contains the current state. The
+// journal is appended to as before until the rewritten one replaced it.
+func (j *journal) compact() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for key, value := range j.state {
+		if err := enc.Encode(journalEntry{Op: "put", Key: key, Value: value}); err != nil {
+			return abort(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return abort(err)
+	}
+	if err := f.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return abort(err)
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	j.entries = len(j.state)
+	return nil
+}
+
+// write appends entries to the journal with a single sync and applies them
+// once they are on disk. If the write fails, the journal is cut back to its
+// previous size, so none of the entries come back on the next open.
+func (j *journal) write(entries []journalEntry) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+	if j.state == nil {
+		return fmt.Errorf("journal %s is not opened", j.path)
+	}
+
+	if j.path != "" {
+		if j.file == nil {
+			return fmt.Errorf("journal %s is closed", j.path)
+		}
+		var buf []byte
+		for _, e := range entries {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			buf = append(append(buf, b...), '\n')
+		}
+		fi, err := j.file.Stat()
+		if err != nil {
+			return err
+		}
+		if _, err := j.file.Write(buf); err != nil {
+			j.file.Truncate(fi.Size())
+			return err
+		}
+		if err := j.file.Sync(); err != nil {
+			j.file.Truncate(fi.Size())
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		j.apply(e)
+	}
+	j.entries += len(entries)
+	// the entries are on disk already, compacting is tried again with the
+	// next write
+	if j.path != "" && j.unreadable == 0 && j.entries > maxJournalEntries+len(j.state) {
+		if err := j.compact(); err != nil {
+			log.Printf("could not compact %s: %v", j.path, err)
+		}
+	}
+	return nil
+}
+
+// Put stores values by key in one write.
+func (j *journal) Put(values map[string]interface{}) error {
+	entries := make([]journalEntry, 0, len(values))
+	for key, v := range values {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, journalEntry{Op: "put", Key: key, Value: b})
+	}
+	return j.write(entries)
+}
+
+func (j *journal) Delete(key string) error {
+	return j.write([]journalEntry{{Op: "delete", Key: key}})
+}
+
+// Each calls fn for every value in the journal.
+func (j *journal) Each(fn func(key string, value json.RawMessage)) {
+	j.Lock()
+	defer j.Unlock()
+
+	for key, value := range j.state {
+		fn(key, value)
+	}
+}
+
+func (j *journal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
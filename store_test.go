@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openJournal(t *testing.T, path string) *journal {
+	t.Helper()
+	j := &journal{path: path}
+	if err := j.open(); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return j
+}
+
+func journalKeys(j *journal) map[string]string {
+	out := map[string]string{}
+	j.Each(func(key string, value json.RawMessage) {
+		out[key] = string(value)
+	})
+	return out
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.db")
+	data := `{"op":"put","key":"a","value":1}
+{"op":"put","key":"b","value":2}
+{"op":"put","key":"c","val`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := openJournal(t, path)
+	if err := j.Put(map[string]interface{}{"d": 4}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	j.Close()
+
+	got := journalKeys(openJournal(t, path))
+	want := map[string]string{"a": "1", "b": "2", "d": "4"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func TestJournalFailedCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.db")
+	j := openJournal(t, path)
+	defer j.Close()
+
+	// the rewritten journal can't replace a directory
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Join(path, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.compact(); err == nil {
+		t.Fatal("compact succeeded")
+	}
+	if err := j.Put(map[string]interface{}{"a": 1}); err != nil {
+		t.Fatalf("Put after failed compaction: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was left behind: %v", err)
+	}
+}
+
+// failingStore fails to persist anything.
+type failingStore struct{}
+
+var errStore = errors.New("disk full")
+
+func (failingStore) Load() (map[string]Lock, error) { return map[string]Lock{}, nil }
+func (failingStore) Put(string, Lock) error         { return errStore }
+func (failingStore) PutMany(map[string]Lock) error  { return errStore }
+func (failingStore) Delete(string) error            { return errStore }
+func (failingStore) Close() error                   { return nil }
+
+// fullStore persists locks to a LockStore until room of them are stored,
+// like a disk filling up, on which not even deletions can be written.
+type fullStore struct {
+	LockStore
+	room int
+}
+
+func (s *fullStore) Put(ip string, lock Lock) error {
+	return s.PutMany(map[string]Lock{ip: lock})
+}
+
+func (s *fullStore) PutMany(locks map[string]Lock) error {
+	if len(locks) > s.room {
+		return errStore
+	}
+	s.room -= len(locks)
+	return s.LockStore.PutMany(locks)
+}
+
+func (s *fullStore) Delete(string) error { return errStore }
+
+func TestLockerStoreErrors(t *testing.T) {
+	var l Locker
+	if err := l.Init(30, failingStore{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Add("192.0.2.1", "test", ""); err == nil || err == ErrLocked {
+		t.Errorf("Add = %v, want the error of the store", err)
+	}
+	if _, ok := l.List()["192.0.2.1"]; ok {
+		t.Error("lock was kept although it was not persisted")
+	}
+	if err := l.AddMany([]string{"192.0.2.1", "192.0.2.2"}, "test", ""); err == nil {
+		t.Error("AddMany succeeded")
+	}
+	if len(l.List()) != 0 {
+		t.Errorf("locks were kept although they were not persisted: %v", l.List())
+	}
+
+	l.locks["192.0.2.3"] = Lock{Comment: "test"}
+	if _, err := l.Delete("192.0.2.3"); err == nil {
+		t.Error("Delete succeeded")
+	}
+	if _, ok := l.List()["192.0.2.3"]; !ok {
+		t.Error("lock was removed although the removal was not persisted")
+	}
+}
+
+func TestLockerAddManyPartialFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.db")
+	s, err := NewLockStore("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l Locker
+	if err := l.Init(30, &fullStore{LockStore: s, room: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Add("192.0.2.1", "single", ""); err != nil {
+		t.Fatal(err)
+	}
+	// there is room for one more lock only
+	if err := l.AddMany([]string{"192.0.2.2", "192.0.2.3", "192.0.2.4"}, "block", ""); err == nil {
+		t.Fatal("AddMany succeeded")
+	}
+	if got := len(l.List()); got != 1 {
+		t.Errorf("%d locks were kept, want 1: %v", got, l.List())
+	}
+	s.Close()
+
+	s, err = NewLockStore("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	locks, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := locks["192.0.2.1"]; !ok || len(locks) != 1 {
+		t.Errorf("locks after reopening = %v, want only 192.0.2.1", locks)
+	}
+}
+
+func TestJournalFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]string
+	}{
+		{
+			name: "current",
+			data: `{"op":"put","key":"a","value":{"comment":"x"}}
+{"op":"put","key":"b","value":2}
+{"op":"delete","key":"b"}
+`,
+			want: map[string]string{"a": `{"comment":"x"}`},
+		},
+		{
+			name: "locks before values",
+			data: `{"op":"put","ip":"192.0.2.1","lock":{"comment":"x"}}
+{"op":"put","ip":"192.0.2.2","lock":{"comment":"y"}}
+{"op":"delete","ip":"192.0.2.2"}
+`,
+			want: map[string]string{"192.0.2.1": `{"comment":"x"}`},
+		},
+		{
+			name: "mixed",
+			data: `{"op":"put","ip":"192.0.2.1","lock":{"comment":"x"}}
+{"op":"put","key":"192.0.2.2","value":{"comment":"y"}}
+`,
+			want: map[string]string{"192.0.2.1": `{"comment":"x"}`, "192.0.2.2": `{"comment":"y"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "locks.db")
+			if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// the second open replays what the first one compacted
+			for i := 0; i < 2; i++ {
+				j := openJournal(t, path)
+				got := journalKeys(j)
+				j.Close()
+				if len(got) != len(tt.want) {
+					t.Fatalf("open %d: got %v, want %v", i+1, got, tt.want)
+				}
+				for key, value := range tt.want {
+					if got[key] != value {
+						t.Errorf("open %d: %s = %q, want %q", i+1, key, got[key], value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestJournalUnreadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.db")
+	data := `{"op":"put","key":"a","value":1}
+{"op":"put","key":"b","value":
+{"op":"frobnicate","key":"c"}
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := openJournal(t, path)
+	if j.unreadable != 2 {
+		t.Errorf("unreadable = %d, want 2", j.unreadable)
+	}
+	for i := 0; i < maxJournalEntries+1; i++ {
+		if err := j.Put(map[string]interface{}{"d": i}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	j.Close()
+
+	written, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(written), data) {
+		t.Error("records which could not be read were compacted away")
+	}
+	got := journalKeys(openJournal(t, path))
+	if got["a"] != "1" || got["d"] != fmt.Sprint(maxJournalEntries) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestLockStoreFormatOfLocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.db")
+	data := `{"op":"put","ip":"192.0.2.1","lock":{"comment":"web","confirmed":true}}
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewLockStore("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	locks, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := locks["192.0.2.1"]; !ok || l.Comment != "web" || !l.Confirmed {
+		t.Errorf("locks = %v", locks)
+	}
+}
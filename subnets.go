@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// span is a range of addresses as integers, from start up to but not
+// including end.
+type span struct {
+	start, end *big.Int
+}
+
+// cidrSpan returns the addresses of a network as a span.
+func cidrSpan(ipnet *net.IPNet) span {
+	ones, bits := ipnet.Mask.Size()
+	start := ipToInt(ipnet.IP)
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	return span{start: start, end: new(big.Int).Add(start, size)}
+}
+
+// freeSubnetList lists the free subnets of a container.
+type freeSubnetList struct {
+	Container string   `json:"container"`
+	CIDR      string   `json:"cidr"`
+	Prefix    int      `json:"prefix"`
+	Subnets   []string `json:"subnets"`
+}
+
+// freeSubnets returns up to limit subnets of the container with a prefix
+// length of prefix, aligned to it, which don't overlap any of the networks
+// in list. Networks holding the container, like the container itself and
+// its parents, are left out.
+func freeSubnets(container *network, prefix int, list []*network, limit int) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(container.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if prefix < ones || prefix > bits {
+		return nil, fmt.Errorf("prefix length has to be between %d and %d", ones, bits)
+	}
+	within := cidrSpan(ipnet)
+
+	var used []span
+	for _, o := range list {
+		if o.Name == container.Name || o.Encloses(*container) || !o.Overlaps(*container) {
+			continue
+		}
+		_, onet, err := net.ParseCIDR(o.CIDR)
+		if err != nil || o.Bits() != bits {
+			continue
+		}
+		used = append(used, cidrSpan(onet))
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].start.Cmp(used[j].start) < 0
+	})
+
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefix))
+	mask := net.CIDRMask(prefix, bits)
+	out := []string{}
+	cur := new(big.Int).Set(within.start)
+	next := new(big.Int)
+	for i := 0; len(out) < limit; {
+		end := new(big.Int).Add(cur, size)
+		if end.Cmp(within.end) > 0 {
+			break
+		}
+
+		// networks ending before cur can't overlap any later subnet
+		for i < len(used) && used[i].end.Cmp(cur) <= 0 {
+			i++
+		}
+		next.SetInt64(0)
+		for _, u := range used[i:] {
+			if u.start.Cmp(end) >= 0 {
+				break
+			}
+			if u.end.Cmp(cur) > 0 && u.end.Cmp(next) > 0 {
+				next.Set(u.end)
+			}
+		}
+
+		if next.Sign() == 0 {
+			subnet := net.IPNet{IP: intToIP(cur, bits == 32), Mask: mask}
+			out = append(out, subnet.String())
+			cur = end
+			continue
+		}
+		// continue with the first aligned subnet after the networks in the way
+		cur = new(big.Int).Add(next, size)
+		cur.Sub(cur, big.NewInt(1)).Div(cur, size).Mul(cur, size)
+	}
+	return out, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFreeSubnets(t *testing.T) {
+	container := &network{Name: "pool", CIDR: "10.0.0.0/24", Container: true}
+	used := []*network{
+		{Name: "root", CIDR: "10.0.0.0/16", Container: true},
+		container,
+		{Name: "a", CIDR: "10.0.0.0/26"},
+		{Name: "b", CIDR: "10.0.0.96/27"},
+		{Name: "c", CIDR: "10.0.0.200/30"},
+		{Name: "outside", CIDR: "10.0.1.0/24"},
+		{Name: "v6", CIDR: "2001:db8::/64"},
+	}
+	v6 := &network{Name: "pool6", CIDR: "2001:db8:1::/48", Container: true}
+
+	tests := []struct {
+		name      string
+		container *network
+		prefix    int
+		list      []*network
+		limit     int
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "empty container",
+			container: container,
+			prefix:    26,
+			limit:     10,
+			want:      []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26", "10.0.0.192/26"},
+		},
+		{
+			name:      "around networks",
+			container: container,
+			prefix:    27,
+			list:      used,
+			limit:     10,
+			want:      []string{"10.0.0.64/27", "10.0.0.128/27", "10.0.0.160/27", "10.0.0.224/27"},
+		},
+		{
+			name:      "limit",
+			container: container,
+			prefix:    27,
+			list:      used,
+			limit:     2,
+			want:      []string{"10.0.0.64/27", "10.0.0.128/27"},
+		},
+		{
+			name:      "whole container",
+			container: container,
+			prefix:    24,
+			list:      used,
+			limit:     10,
+			want:      []string{},
+		},
+		{
+			name:      "single addresses",
+			container: &network{Name: "small", CIDR: "10.0.0.200/29", Container: true},
+			prefix:    32,
+			list:      used,
+			limit:     10,
+			want:      []string{"10.0.0.204/32", "10.0.0.205/32", "10.0.0.206/32", "10.0.0.207/32"},
+		},
+		{
+			name:      "IPv6",
+			container: v6,
+			prefix:    64,
+			list:      []*network{v6, {Name: "x", CIDR: "2001:db8:1::/63"}},
+			limit:     2,
+			want:      []string{"2001:db8:1:2::/64", "2001:db8:1:3::/64"},
+		},
+		{
+			name:      "prefix shorter than the container",
+			container: container,
+			prefix:    23,
+			limit:     10,
+			wantErr:   true,
+		},
+		{
+			name:      "prefix too long",
+			container: container,
+			prefix:    33,
+			limit:     10,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := freeSubnets(tt.container, tt.prefix, tt.list, tt.limit)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// useNetworks replaces the networks and their definitions with the ones in
+// data for the duration of a test.
+func useNetworks(t *testing.T, data string) {
+	t.Helper()
+	savedNetworks, savedFile := getNetworks(), config.File
+	t.Cleanup(func() {
+		setNetworks(savedNetworks)
+		config.File = savedFile
+	})
+
+	config.File = filepath.Join(t.TempDir(), "netdef.yaml")
+	if err := ioutil.WriteFile(config.File, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := loadNetworks(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setNetworks(list)
+}
+
+// request sends a request without credentials to the routes of router.
+func request(router http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+func TestFreeSubnetHandlers(t *testing.T) {
+	useScanner(t)
+	useNetworks(t, `- name: pool
+  cidr: 10.0.0.0/24
+  container: true
+  dc: dc1
+- name: a
+  cidr: 10.0.0.0/26
+  parent: pool
+`)
+	router := mux.NewRouter()
+	router.HandleFunc("/networks/{net}/free-subnets", GetFreeSubnets).Methods("GET")
+	router.HandleFunc("/networks/{net}/free-subnets", PostFreeSubnet).Methods("POST")
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"GET", "/networks/pool/free-subnets", "", http.StatusBadRequest},
+		{"GET", "/networks/pool/free-subnets?prefix=20", "", http.StatusBadRequest},
+		{"GET", "/networks/pool/free-subnets?prefix=26&limit=0", "", http.StatusBadRequest},
+		{"GET", "/networks/a/free-subnets?prefix=28", "", http.StatusBadRequest},
+		{"GET", "/networks/missing/free-subnets?prefix=28", "", http.StatusNotFound},
+		{"POST", "/networks/pool/free-subnets?prefix=26", `{"name":"a"}`, http.StatusConflict},
+		{"POST", "/networks/pool/free-subnets?prefix=26", `{}`, http.StatusBadRequest},
+		{"POST", "/networks/pool/free-subnets?prefix=24", `{"name":"big"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if res := request(router, tt.method, tt.target, tt.body); res.Code != tt.status {
+			t.Errorf("%s %s: %d %s, want %d", tt.method, tt.target, res.Code, res.Body, tt.status)
+		}
+	}
+
+	res := request(router, "GET", "/networks/pool/free-subnets?prefix=26&limit=2", "")
+	var list freeSubnetList
+	if err := json.Unmarshal(res.Body.Bytes(), &list); err != nil {
+		t.Fatalf("%d %s: %v", res.Code, res.Body, err)
+	}
+	if !reflect.DeepEqual(list.Subnets, []string{"10.0.0.64/26", "10.0.0.128/26"}) || list.Container != "pool" || list.Prefix != 26 {
+		t.Errorf("free subnets = %+v", list)
+	}
+
+	res = request(router, "POST", "/networks/pool/free-subnets?prefix=26", `{"name":"b","description":"new"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", res.Code, res.Body)
+	}
+	b := findNetwork("b")
+	if b == nil || b.CIDR != "10.0.0.64/26" || b.Parent != "pool" || b.DC != "dc1" {
+		t.Fatalf("b = %+v, want the first free subnet in pool", b)
+	}
+	saved, err := loadNetworks(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 3 || saved[2].Name != "b" || saved[2].CIDR != b.CIDR {
+		t.Errorf("definitions = %v, want b added", saved)
+	}
+
+	// the next one is created after b
+	res = request(router, "POST", "/networks/pool/free-subnets?prefix=26", `{"name":"c"}`)
+	if c := findNetwork("c"); res.Code != http.StatusCreated || c == nil || c.CIDR != "10.0.0.128/26" {
+		t.Errorf("POST: %d %s", res.Code, res.Body)
+	}
+}
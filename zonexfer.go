@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zone is a copy of a zone transferred from a DNS server.
+type zone struct {
+	Name    string
+	Serial  uint32
+	records map[string][]dnsRR
+}
+
+func newZone(name string) *zone {
+	return &zone{Name: name, records: make(map[string][]dnsRR)}
+}
+
+func (z *zone) add(rr dnsRR) {
+	if rr.Type == typeSOA {
+		return
+	}
+	name := strings.ToLower(rr.Name)
+	for _, r := range z.records[name] {
+		if sameRR(r, rr) {
+			return
+		}
+	}
+	z.records[name] = append(z.records[name], rr)
+}
+
+func (z *zone) remove(rr dnsRR) {
+	name := strings.ToLower(rr.Name)
+	rrs := z.records[name]
+	for i, r := range rrs {
+		if sameRR(r, rr) {
+			rrs = append(rrs[:i:i], rrs[i+1:]...)
+			break
+		}
+	}
+	if len(rrs) == 0 {
+		delete(z.records, name)
+	} else {
+		z.records[name] = rrs
+	}
+}
+
+func sameRR(a, b dnsRR) bool {
+	return a.Type == b.Type && a.Class == b.Class && bytes.Equal(a.Data, b.Data)
+}
+
+// zoneSet is the set of zones used to resolve the IPs of a network.
+type zoneSet []*zone
+
+// lookup returns the records of name of the given type. It returns false if
+// name is not part of any zone of the set, in which case it has to be
+// resolved otherwise.
+func (zs zoneSet) lookup(name string, typ uint16) ([]dnsRR, bool) {
+	var best *zone
+	for _, z := range zs {
+		if inZone(name, z.Name) && (best == nil || len(z.Name) > len(best.Name)) {
+			best = z
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+
+	var out []dnsRR
+	for _, rr := range best.records[strings.ToLower(fqdn(name))] {
+		if rr.Type == typ {
+			out = append(out, rr)
+		}
+	}
+	return out, true
+}
+
+// addresses returns the IPs name resolves to, following CNAMEs. Names
+// outside the zones are resolved with dns.
+func (zs zoneSet) addresses(ctx context.Context, dns dnsLookup, name string) ([]net.IP, error) {
+	for hops := 0; hops < 8; hops++ {
+		cnames, ok := zs.lookup(name, typeCNAME)
+		if !ok {
+			addrs, err := dns.LookupHost(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			var ips []net.IP
+			for _, addr := range addrs {
+				ips = append(ips, net.ParseIP(addr))
+			}
+			return ips, nil
+		}
+		if len(cnames) > 0 {
+			name = cnames[0].Target()
+			continue
+		}
+
+		var ips []net.IP
+		for _, typ := range []uint16{typeA, typeAAAA} {
+			rrs, _ := zs.lookup(name, typ)
+			for _, rr := range rrs {
+				ips = append(ips, rr.IP())
+			}
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses found for %s", name)
+		}
+		return ips, nil
+	}
+	return nil, fmt.Errorf("too many CNAMEs for %s", name)
+}
+
+// resolve returns the PTR of ip, the TXT records of the name it points to
+// and the address that name resolves to, like Resolv. It returns false if
+// the reverse zone of ip is not part of the set. Names outside the zones
+// are resolved with dns.
+func (zs zoneSet) resolve(ctx context.Context, dns dnsLookup, ip net.IP) (*Response, bool) {
+	ptrs, ok := zs.lookup(reverseName(ip), typePTR)
+	if !ok {
+		return nil, false
+	}
+	if len(ptrs) == 0 {
+		return nil, true
+	}
+
+	resp := &Response{Addr: ip, PTR: ptrs[0].Target()}
+	if txts, ok := zs.lookup(resp.PTR, typeTXT); ok {
+		var strs []string
+		for _, rr := range txts {
+			strs = append(strs, rr.TXT())
+		}
+		resp.TXT = strings.Join(strs, ", ")
+	} else {
+		resp.TXT = resolvTXT(ctx, dns, resp.PTR)
+	}
+
+	if addrs, err := zs.addresses(ctx, dns, resp.PTR); err == nil {
+		resp.A = addrs[0]
+		// prefer an address of the same family as ip
+		for _, addr := range addrs {
+			if (addr.To4() == nil) == (ip.To4() == nil) {
+				resp.A = addr
+				break
+			}
+		}
+	}
+	return resp, true
+}
+
+// ZoneTransfer keeps copies of the reverse and forward zones of all
+// networks, transferred from a primary DNS server with AXFR and kept up to
+// date with IXFR. Scans resolve IPs from these copies instead of querying
+// DNS for every IP. The mutex only protects the maps, transfers of
+// different zones run in parallel.
+type ZoneTransfer struct {
+	sync.Mutex
+	Server  string
+	Key     *tsigKey
+	Timeout time.Duration
+	zones   map[string]*zone
+	names   map[string][]string
+	running map[string]chan struct{}
+}
+
+// NewZoneTransfer creates a ZoneTransfer from server, signing requests with
+// key if it is not empty. See parseTSIGKey for the format of key.
+func NewZoneTransfer(server string, key string) (*ZoneTransfer, error) {
+	t := &ZoneTransfer{
+		Server:  withPort(server),
+		Timeout: 30 * time.Second,
+		zones:   make(map[string]*zone),
+		names:   make(map[string][]string),
+		running: make(map[string]chan struct{}),
+	}
+	if key != "" {
+		k, err := parseTSIGKey(key)
+		if err != nil {
+			return nil, err
+		}
+		t.Key = k
+	}
+	return t, nil
+}
+
+// maxZoneQueries is the number of names queried to find the reverse zones
+// of a network.
+const maxZoneQueries = 256
+
+// reverseNames returns names within the reverse zones of n, one for every
+// part of it which could be delegated as a zone of its own: every /24 of
+// IPv4 networks down to a /16 and every nibble boundary of IPv6 networks.
+func reverseNames(n *network) ([]string, error) {
+	_, ipnet, err := net.ParseCIDR(n.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+
+	step := 4
+	if bits == 32 {
+		step = 8
+	}
+	boundary := (ones + step - 1) / step * step
+	if bits == 32 {
+		if boundary > 24 {
+			boundary = 24
+		}
+		for boundary < 24 && boundary+step-ones <= 8 {
+			boundary += step
+		}
+	}
+
+	count := 1
+	if boundary > ones {
+		count = 1 << uint(boundary-ones)
+	}
+
+	var names []string
+	ip := dupIP(ipnet.IP)
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	mask := net.CIDRMask(boundary, bits)
+	for i := 0; i < count && i < maxZoneQueries; i++ {
+		name := reverseName(ip.Mask(mask))
+		// strip the labels below the boundary
+		labels := strings.SplitN(name, ".", (bits-boundary)/step+1)
+		names = append(names, labels[len(labels)-1])
+		ip = nextIP(lastIP(ip, mask))
+	}
+	return names, nil
+}
+
+// lastIP returns the last IP of the network of ip with the given mask.
+func lastIP(ip net.IP, mask net.IPMask) net.IP {
+	out := dupIP(ip)
+	for i := range out {
+		out[i] |= ^mask[i]
+	}
+	return out
+}
+
+// zoneNames returns the names of the reverse zones of n and of the forward
+// zone of its domain. They are looked up once and remembered until the
+// network definitions are reloaded.
+func (t *ZoneTransfer) zoneNames(n *network) ([]string, error) {
+	key := n.CIDR + " " + n.Domain
+	t.Lock()
+	names, ok := t.names[key]
+	t.Unlock()
+	if ok {
+		return names, nil
+	}
+
+	queries, err := reverseNames(n)
+	if err != nil {
+		return nil, err
+	}
+	if n.Domain != "" {
+		queries = append(queries, n.Domain)
+	}
+
+	seen := map[string]bool{}
+	for _, q := range queries {
+		name, err := findZone(t.Server, t.Key, q, t.Timeout)
+		if err != nil {
+			log.Printf("no zone found for %s of network %s: %v", q, n.Name, err)
+			continue
+		}
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no zones found for network %s", n.Name)
+	}
+	t.Lock()
+	t.names[key] = names
+	t.Unlock()
+	return names, nil
+}
+
+// Forget drops the remembered zone names, as the zones of networks may
+// have changed together with their definitions.
+func (t *ZoneTransfer) Forget() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.names = make(map[string][]string)
+}
+
+// Zones transfers the zones of a network, or the changes since they were
+// last transferred, and returns them.
+func (t *ZoneTransfer) Zones(n *network) (zoneSet, error) {
+	names, err := t.zoneNames(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var zs zoneSet
+	for _, name := range names {
+		if z := t.update(name); z != nil {
+			zs = append(zs, z)
+		}
+	}
+	if len(zs) == 0 {
+		return nil, fmt.Errorf("no zones of network %s could be transferred", n.Name)
+	}
+	return zs, nil
+}
+
+// update transfers a zone and returns the new copy of it, or the last one
+// if the transfer failed. If the zone is already being transferred, it
+// waits for that transfer instead of starting another one.
+func (t *ZoneTransfer) update(name string) *zone {
+	t.Lock()
+	if wait, ok := t.running[name]; ok {
+		t.Unlock()
+		<-wait
+		t.Lock()
+		defer t.Unlock()
+		return t.zones[name]
+	}
+	done := make(chan struct{})
+	t.running[name] = done
+	old := t.zones[name]
+	t.Unlock()
+
+	z, err := t.transfer(name, old)
+	if err != nil {
+		log.Printf("transfer of zone %s failed: %v", name, err)
+		z = old
+	}
+
+	t.Lock()
+	if z != nil {
+		t.zones[name] = z
+	}
+	delete(t.running, name)
+	t.Unlock()
+	close(done)
+	return z
+}
+
+// transfer requests a zone with AXFR if old is nil, or the changes since
+// old with IXFR otherwise. It returns a new copy of the zone, old is never
+// modified.
+func (t *ZoneTransfer) transfer(name string, old *zone) (*zone, error) {
+	m := &dnsMsg{
+		ID:       newMsgID(),
+		Question: []dnsQuestion{{Name: name, Type: typeAXFR, Class: classINET}},
+	}
+	if old != nil {
+		m.Question[0].Type = typeIXFR
+		m.Authority = []dnsRR{soaRR(name, old.Serial)}
+	}
+	b, mac, err := packMsg(m, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	v := &tsigVerifier{key: t.Key, mac: mac}
+
+	c, err := dialDNS(t.Server, true, t.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.write(b); err != nil {
+		return nil, err
+	}
+
+	// read messages until the zone is complete, which is when the SOA
+	// of the new version was seen twice for a full transfer, or three
+	// times for an incremental one
+	var rrs []dnsRR
+	var serial uint32
+	incremental := false
+	seen := 0
+	for {
+		c.conn.SetDeadline(time.Now().Add(t.Timeout))
+		resp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		// only the first message has to repeat the question (RFC 5936
+		// section 2.2.1)
+		if resp.ID != m.ID || (len(rrs) == 0 || len(resp.Question) > 0) && !resp.answers(m) {
+			continue
+		}
+		if err := v.verify(resp, time.Now()); err != nil {
+			return nil, err
+		}
+		if resp.Rcode() != rcodeSuccess {
+			return nil, rcodeError(resp.Rcode())
+		}
+		for _, rr := range resp.Answer {
+			if len(rrs) == 0 {
+				if rr.Type != typeSOA {
+					return nil, errors.New("zone transfer does not start with a SOA record")
+				}
+				serial = rr.Serial()
+			}
+			if len(rrs) == 1 && old != nil && rr.Type == typeSOA && rr.Serial() != serial {
+				incremental = true
+			}
+			if rr.Type == typeSOA && rr.Serial() == serial {
+				seen++
+			}
+			rrs = append(rrs, rr)
+		}
+		if len(rrs) == 1 && old != nil && serial == old.Serial {
+			// up to date
+			if err := v.done(); err != nil {
+				return nil, err
+			}
+			return old, nil
+		}
+		if len(rrs) > 1 && (seen == 2 && !incremental || seen == 3) {
+			break
+		}
+	}
+	if err := v.done(); err != nil {
+		return nil, err
+	}
+
+	z := newZone(name)
+	z.Serial = serial
+	if !incremental {
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			z.add(rr)
+		}
+		return z, nil
+	}
+
+	for owner, records := range old.records {
+		z.records[owner] = append([]dnsRR{}, records...)
+	}
+	// the changes consist of the SOA of the old version followed by the
+	// deleted records and the SOA of the new version followed by the
+	// added ones, for every version in between
+	adding := true
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		switch {
+		case rr.Type == typeSOA:
+			adding = !adding
+		case adding:
+			z.add(rr)
+		default:
+			z.remove(rr)
+		}
+	}
+	return z, nil
+}